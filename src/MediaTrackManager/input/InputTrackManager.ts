@@ -1,17 +1,21 @@
 import {
     useLocalUserStateStore, useRemoteUsersStore,
-    useAudioProcessing, useWsStore, useDesktopCapture
+    useAudioProcessing, useWsStore, useDesktopCapture, useCameraCapture
 } from "@/stores"
 import InputAudioProcessor from "./audioEncoder"
 import InputVideoProcessor from "./videoEncoder"
-import { TrackID } from "@/types"
+import { CodecID, TrackID, type CodecIDType } from "@/types"
 
 
 export class InputTrackManager {
     private static instance: InputTrackManager | null = null;
     private microphoneProcessor: InputAudioProcessor | null = null;
     private cpaProcessor: InputAudioProcessor | null = null;
-    private screenProcessor: InputVideoProcessor | null = null;
+    // screen share is encoded once per codec the gateway negotiated with a peer
+    private screenProcessors: Map<CodecIDType, InputVideoProcessor> = new Map();
+    private screenCodecs: CodecIDType[] = [CodecID.VP9];
+    // the camera is always VP8, like the gateway's camera track
+    private cameraProcessor: InputVideoProcessor | null = null;
 
     private constructor() {
         // only subscribe core state changes
@@ -20,6 +24,7 @@ export class InputTrackManager {
                 isInChat: state.userState.isInChat,
                 isSharingAudio: state.userState.isSharingAudio,
                 isSharingScreen: state.userState.isSharingScreen,
+                isSharingCamera: state.userState.isSharingCamera,
             }),
             (current, previous) => {
                 console.log('[MediaTrackManager] Local user state changed:', { previous, current });
@@ -32,6 +37,7 @@ export class InputTrackManager {
                     // 如果在进入前本地已勾选共享状态（例如持久化恢复），补启动
                     if (current.isSharingAudio) this.startTransCpaAudio();
                     if (current.isSharingScreen) this.startTransScreenVideo();
+                    if (current.isSharingCamera) this.startTransCameraVideo();
                 }
 
                 if (leftChat) {
@@ -39,6 +45,7 @@ export class InputTrackManager {
                     this.stopTransMicAudio();
                     this.stopTransCpaAudio();
                     this.stopTransScreenVideo();
+                    this.stopTransCameraVideo();
                     return;
                 }
 
@@ -54,6 +61,12 @@ export class InputTrackManager {
                     } else if (!current.isSharingScreen && previous.isSharingScreen) {
                         this.stopTransScreenVideo();
                     }
+
+                    if (current.isSharingCamera && !previous.isSharingCamera) {
+                        this.startTransCameraVideo();
+                    } else if (!current.isSharingCamera && previous.isSharingCamera) {
+                        this.stopTransCameraVideo();
+                    }
                 }
             }
         );
@@ -145,7 +158,7 @@ export class InputTrackManager {
     }
 
     private async startTransScreenVideo(): Promise<void> {
-        if (this.screenProcessor?.isActive()) {
+        if (this.screenCodecs.every(codec => this.screenProcessors.has(codec))) {
             console.log('[MediaTrackManager] Screen video transmission already active');
             return;
         }
@@ -168,13 +181,50 @@ export class InputTrackManager {
             return;
         }
 
+        for (const codec of this.screenCodecs) {
+            if (this.screenProcessors.has(codec)) continue;
+            try {
+                this.screenProcessors.set(codec, new InputVideoProcessor(TrackID.SCREEN_SHARE_VIDEO, mediaWs, screenVideoTrack, codec));
+                console.log(`[MediaTrackManager] Started transmitting screen video, codec ${codec}`);
+
+            } catch (error) {
+                console.error(`[MediaTrackManager] Failed to start screen video transmission, codec ${codec}:`, error);
+                this.screenProcessors.delete(codec);
+            }
+        }
+    }
+
+    private async startTransCameraVideo(): Promise<void> {
+        if (this.cameraProcessor?.isActive()) {
+            console.log('[MediaTrackManager] Camera video transmission already active');
+            return;
+        }
+
+        const stream = await useCameraCapture.getState().startCamera();
+        if (!stream) {
+            console.warn('[MediaTrackManager] No camera stream available for camera video.');
+            return;
+        }
+
+        const cameraVideoTrack = stream.getVideoTracks()[0];
+        if (!cameraVideoTrack) {
+            console.warn('[MediaTrackManager] No camera video track available.');
+            return;
+        }
+
+        const { mediaWs } = useWsStore.getState();
+        if (!mediaWs) {
+            console.warn('[MediaTrackManager] No media WebSocket available.');
+            return;
+        }
+
         try {
-            this.screenProcessor = new InputVideoProcessor(TrackID.SCREEN_SHARE_VIDEO, mediaWs, screenVideoTrack);
-            console.log('[MediaTrackManager] Started transmitting screen video');
+            this.cameraProcessor = new InputVideoProcessor(TrackID.CAMERA_VIDEO, mediaWs, cameraVideoTrack, CodecID.VP8);
+            console.log('[MediaTrackManager] Started transmitting camera video');
 
         } catch (error) {
-            console.error('[MediaTrackManager] Failed to start screen video transmission:', error);
-            this.screenProcessor = null;
+            console.error('[MediaTrackManager] Failed to start camera video transmission:', error);
+            this.cameraProcessor = null;
         }
     }
 
@@ -194,14 +244,56 @@ export class InputTrackManager {
         }
     }
 
-    private async stopTransScreenVideo(): Promise<void> {
-        if (this.screenProcessor) {
-            this.screenProcessor.stop();
-            this.screenProcessor = null;
-            console.log('[MediaTrackManager] Stopped transmitting screen video');
+    private async stopTransScreenVideo(codecs?: CodecIDType[]): Promise<void> {
+        for (const [codec, processor] of this.screenProcessors) {
+            if (codecs && !codecs.includes(codec)) continue;
+            processor.stop();
+            this.screenProcessors.delete(codec);
+            console.log(`[MediaTrackManager] Stopped transmitting screen video, codec ${codec}`);
+        }
+    }
+
+    private async stopTransCameraVideo(): Promise<void> {
+        if (this.cameraProcessor) {
+            this.cameraProcessor.stop();
+            this.cameraProcessor = null;
+            console.log('[MediaTrackManager] Stopped transmitting camera video');
+        }
+        useCameraCapture.getState().stopCamera();
+    }
+
+    // updateScreenCodecs follows the codecs reported in rtc_status
+    private updateScreenCodecs(codecs: CodecIDType[]): void {
+        const changed = codecs.length !== this.screenCodecs.length || codecs.some((codec, i) => codec !== this.screenCodecs[i]);
+        if (!changed) return;
+        console.log('[MediaTrackManager] Screen codecs changed:', { previous: this.screenCodecs, current: codecs });
+
+        const removed = this.screenCodecs.filter(codec => !codecs.includes(codec));
+        this.screenCodecs = codecs;
+        this.stopTransScreenVideo(removed);
+
+        const { userState } = useLocalUserStateStore.getState();
+        if (userState.isInChat && userState.isSharingScreen) {
+            this.startTransScreenVideo();
         }
     }
 
+    // requestKeyframe forwards a requestKeyframe message from the gateway to
+    // the encoder of the codec and simulcast layer the waiting peers receive
+    public static requestKeyframe(trackID: number, codec: number, layer: number): void {
+        if (trackID === TrackID.CAMERA_VIDEO) {
+            InputTrackManager.instance?.cameraProcessor?.requestKeyFrame(layer);
+            return;
+        }
+        if (trackID !== TrackID.SCREEN_SHARE_VIDEO) return;
+        InputTrackManager.instance?.screenProcessors.get(codec as CodecIDType)?.requestKeyFrame(layer);
+    }
+
+    public static setScreenCodecs(codecs: number[]): void {
+        const known = Object.values(CodecID) as number[];
+        InputTrackManager.instance?.updateScreenCodecs(codecs.filter(codec => known.includes(codec)) as CodecIDType[]);
+    }
+
     public static init(): void {
         if (InputTrackManager.instance) {
             console.warn('[MediaTrackManager] Already initialized, skipping...');
@@ -1,4 +1,4 @@
-import { TrackID, type TrackIDType } from "@/types"
+import { CODEC_STRINGS, CodecID, TrackID, type CodecIDType, type TrackIDType } from "@/types"
 
 const ProcessorState = {
     IDLE: 'idle',
@@ -10,18 +10,46 @@ const ProcessorState = {
 
 type ProcessorStateType = typeof ProcessorState[keyof typeof ProcessorState];
 
+// simulcast layers, low to high. the bitrates match videoBitrateList in the
+// gateway, which forwards each peer the highest layer its bandwidth allows
+const SIMULCAST_LAYERS = [
+    { scaleDown: 4, bitrate: 300_000 },
+    { scaleDown: 2, bitrate: 1_000_000 },
+    { scaleDown: 1, bitrate: 5_000_000 },
+];
+
+// the camera's layers, matching cameraBitrateList in the gateway
+const CAMERA_SIMULCAST_LAYERS = [
+    { scaleDown: 4, bitrate: 150_000 },
+    { scaleDown: 2, bitrate: 500_000 },
+    { scaleDown: 1, bitrate: 1_500_000 },
+];
+
+// VP9 layers also carry temporal layers where the encoder can, the gateway
+// thins them for peers whose bandwidth doesn't fit the layer they get. H.264
+// and AV1 layers don't, the gateway only parses VP9 layers
+const SVC_SCALABILITY_MODE = 'L1T3';
+
+const VIDEO_FRAME_HEADER_SIZE = 19;
+const CHUNK_FLAG_KEYFRAME = 1 << 0;
+const CHUNK_FLAG_SVC = 1 << 1; // bits 2-4 temporal layer ID, bits 5-7 spatial layer ID
+
 export default class InputVideoProcessor {
     private trackID: TrackIDType;
+    private codec: CodecIDType;
     private ws: WebSocket;
-    private encoder: VideoEncoder | null = null;
+    private encoders: (VideoEncoder | null)[] = []; // index is the simulcast layer
+    private layerSizes: { width: number, height: number }[] = []; // index is the simulcast layer
     private state: ProcessorStateType = ProcessorState.IDLE;
-    private videoConfig: VideoEncoderConfig | null = null;
+    private videoConfig: VideoEncoderConfig | null = null; // top layer
     private videoTrack: MediaStreamVideoTrack;
     private frameCount: number = 0;
     private keyFrameInterval: number = 30;
+    private keyFramesRequested: Set<number> = new Set(); // layers a peer asked a keyframe of, see requestKeyFrame
 
-    constructor(trackID: TrackIDType, ws: WebSocket, videoTrack: MediaStreamVideoTrack) {
+    constructor(trackID: TrackIDType, ws: WebSocket, videoTrack: MediaStreamVideoTrack, codec: CodecIDType = CodecID.VP9) {
         this.trackID = trackID;
+        this.codec = codec;
         this.ws = ws;
         this.videoTrack = videoTrack;
         this.encodeFromVideoTrack(videoTrack);
@@ -31,6 +59,12 @@ export default class InputVideoProcessor {
         return this.state === ProcessorState.RUNNING;
     }
 
+    // requestKeyFrame makes the next frame of a simulcast layer a keyframe, the
+    // gateway already rate limits and aggregates the requests of its peers
+    public requestKeyFrame(layer: number): void {
+        this.keyFramesRequested.add(layer);
+    }
+
     private async init() {
         if (this.state !== ProcessorState.IDLE) {
             return; // 避免重复初始化
@@ -46,16 +80,21 @@ export default class InputVideoProcessor {
             }
 
             const trackSettings = this.videoTrack.getSettings();
+            const width = trackSettings.width || 1920;
+            const height = trackSettings.height || 1080;
             const config: VideoEncoderConfig = {
-                codec: 'vp09.00.41.08',//'avc1.4d001f',//'hev1.1.6.L93.B0',//'av01.0.01M.08',//
-                width: trackSettings.width || 1920,
-                height: trackSettings.height || 1080,
+                codec: CODEC_STRINGS[this.codec],
+                width,
+                height,
                 framerate: trackSettings.frameRate || 30,
                 bitrate: 1_000_000, // 1 Mbps
                 latencyMode: 'realtime',
                 // hardwareAcceleration: 'prefer-hardware',
                 // scalabilityMode: 'L1T3', // only L1 SVC mode is supported
             };
+            if (this.codec === CodecID.H264) {
+                config.avc = { format: 'annexb' }; // the gateway's payloader wants start codes
+            }
 
             this.videoConfig = config;
 
@@ -85,28 +124,40 @@ export default class InputVideoProcessor {
             //     console.log(`[video encoder] Checking support for scalabilityMode=${mode}:`, support.supported);
             // }
 
-            const support = await VideoEncoder.isConfigSupported(config);
-            if (!support.supported) {
-                console.error('[video encoder] VideoEncoder configuration not supported:', support);
-                this.state = ProcessorState.STOPPED;
-                return;
-            }
+            const layers = this.trackID === TrackID.CAMERA_VIDEO ? CAMERA_SIMULCAST_LAYERS : SIMULCAST_LAYERS;
+            for (const [layer, { scaleDown, bitrate }] of layers.entries()) {
+                let layerConfig: VideoEncoderConfig = {
+                    ...config,
+                    // even sizes, 4:2:0 needs them
+                    width: Math.max(2, Math.round(width / scaleDown / 2) * 2),
+                    height: Math.max(2, Math.round(height / scaleDown / 2) * 2),
+                    bitrate,
+                };
+                if (this.codec === CodecID.VP9) {
+                    const svcConfig = { ...layerConfig, scalabilityMode: SVC_SCALABILITY_MODE };
+                    if ((await VideoEncoder.isConfigSupported(svcConfig)).supported) {
+                        layerConfig = svcConfig;
+                    }
+                }
 
-            console.log('[video encoder] VideoEncoder configuration:', config);
+                const support = await VideoEncoder.isConfigSupported(layerConfig);
+                if (!support.supported) {
+                    console.error(`[video encoder] Layer ${layer} configuration not supported:`, support);
+                    this.encoders[layer] = null;
+                    continue;
+                }
 
-            this.encoder = new VideoEncoder({
-                output: this.handleEncodedChunk.bind(this),
-                error: (error) => {
-                    console.error('VideoEncoder error:', error);
-                    // 只有在非停止状态时才重置编码器状态
-                    if (this.state !== ProcessorState.STOPPING) {
-                        this.state = ProcessorState.STOPPED;
-                        this.encoder = null;
-                    }
-                },
-            });
+                console.log(`[video encoder] Layer ${layer} configuration:`, layerConfig);
 
-            this.encoder.configure(config);
+                const encoder = this.createEncoder(layer, layerConfig);
+                this.encoders[layer] = encoder;
+            }
+
+            if (this.encoders.every(e => e === null)) {
+                console.error('[video encoder] No simulcast layer is supported');
+                this.state = ProcessorState.STOPPED;
+                return;
+            }
             this.state = ProcessorState.RUNNING;
         } catch (error) {
             console.error('[video encoder] Failed to initialize VideoEncoder:', error);
@@ -114,13 +165,34 @@ export default class InputVideoProcessor {
         }
     }
 
-    private handleEncodedChunk(chunk: EncodedVideoChunk, _metadata?: EncodedVideoChunkMetadata) {
+    private createEncoder(layer: number, config: VideoEncoderConfig): VideoEncoder {
+        const encoder = new VideoEncoder({
+            output: (chunk, metadata) => this.handleEncodedChunk(layer, chunk, metadata),
+            error: (error) => {
+                console.error(`VideoEncoder error on layer ${layer}:`, error);
+                // 只有在非停止状态时才重置编码器状态, 其他层继续编码
+                if (this.state !== ProcessorState.STOPPING) {
+                    this.encoders[layer] = null;
+                    if (this.encoders.every(e => e === null)) {
+                        this.state = ProcessorState.STOPPED;
+                    }
+                }
+            },
+        });
+        encoder.configure(config);
+        this.layerSizes[layer] = { width: config.width, height: config.height };
+        return encoder;
+    }
+
+    private handleEncodedChunk(layer: number, chunk: EncodedVideoChunk, metadata?: EncodedVideoChunkMetadata) {
         // printChunkInfo(chunk, this.videoConfig);
 
         const buffer = new Uint8Array(chunk.byteLength);
         chunk.copyTo(buffer);
 
-        const headerSize = 1 + 8;
+        // [trackID] + video frame header, see rtc_frames.go in the gateway:
+        // codec, flags, layer, capture timestamp (µs), RTP timestamp (the gateway fills it), width, height
+        const headerSize = 1 + VIDEO_FRAME_HEADER_SIZE;
         const totalSize = headerSize + buffer.length;
         const packet = new ArrayBuffer(totalSize);
         const view = new DataView(packet);
@@ -129,10 +201,32 @@ export default class InputVideoProcessor {
         view.setUint8(offset, this.trackID); // 轨道ID
         offset += 1;
 
-        const duration = chunk.duration || 0;
-        view.setBigUint64(offset, BigInt(duration), true);
+        view.setUint8(offset, this.codec); // 编码格式
+        offset += 1;
+
+        let flags = chunk.type === 'key' ? CHUNK_FLAG_KEYFRAME : 0;
+        if (metadata?.svc) {
+            flags |= CHUNK_FLAG_SVC | (metadata.svc.temporalLayerId & 0x07) << 2;
+        }
+        view.setUint8(offset, flags);
+        offset += 1;
+
+        view.setUint8(offset, layer); // simulcast 层
+        offset += 1;
+
+        // the gateway paces frames by the capture timestamps
+        view.setBigUint64(offset, BigInt(Math.max(0, Math.round(chunk.timestamp))), true);
         offset += 8;
 
+        view.setUint32(offset, 0, true);
+        offset += 4;
+
+        const size = this.layerSizes[layer];
+        view.setUint16(offset, size?.width ?? 0, true);
+        offset += 2;
+        view.setUint16(offset, size?.height ?? 0, true);
+        offset += 2;
+
         const dataView = new Uint8Array(packet, offset); // 从offset开始的视图
         dataView.set(buffer);
 
@@ -163,14 +257,21 @@ export default class InputVideoProcessor {
                         await this.init();
                     }
 
-                    if (this.encoder && this.state === ProcessorState.RUNNING) {
-                        try {
-                            const needsKeyFrame = this.frameCount % this.keyFrameInterval === 0;
-                            this.encoder.encode(value, { keyFrame: needsKeyFrame });
-                            this.frameCount++;
-                        } catch (error) {
-                            console.error('Error encoding frame:', error);
+                    if (this.state === ProcessorState.RUNNING) {
+                        // periodic keyframes are on every layer together, so the gateway
+                        // can switch a peer's layer, requested ones only on their layer
+                        const periodic = this.frameCount % this.keyFrameInterval === 0;
+                        const requested = this.keyFramesRequested;
+                        this.keyFramesRequested = new Set();
+                        for (const [layer, encoder] of this.encoders.entries()) {
+                            if (!encoder) continue;
+                            try {
+                                encoder.encode(value, { keyFrame: periodic || requested.has(layer) });
+                            } catch (error) {
+                                console.error('Error encoding frame:', error);
+                            }
                         }
+                        this.frameCount++;
                     }
 
                     value.close();
@@ -189,12 +290,12 @@ export default class InputVideoProcessor {
         this.frameCount = 0;
         this.state = ProcessorState.STOPPING;
 
-        if (this.encoder) {
-            // Flush any pending frames and close the encoder
-            this.encoder.flush()
+        const encoders = this.encoders.filter((e): e is VideoEncoder => e !== null);
+        this.encoders = [];
+        if (encoders.length > 0) {
+            // Flush any pending frames and close the encoders
+            Promise.all(encoders.map(encoder => encoder.flush().then(() => encoder.close())))
                 .then(() => {
-                    this.encoder?.close();
-                    this.encoder = null;
                     this.state = ProcessorState.STOPPED;
                 })
                 .catch(error => {
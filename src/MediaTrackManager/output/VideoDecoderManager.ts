@@ -1,4 +1,4 @@
-import type { TrackIDType } from '@/types';
+import { CODEC_STRINGS, CodecID, type CodecIDType, type TrackIDType } from '@/types';
 import { useVideoStreamStore } from '@/stores/videoStreamStore';
 
 interface VideoDecoderInstance {
@@ -6,6 +6,7 @@ interface VideoDecoderInstance {
     generator: MediaStreamTrackGenerator<VideoFrame>;
     track: MediaStreamTrack;
     writer: WritableStreamDefaultWriter<VideoFrame>;
+    codec: CodecIDType;
     waitingForKeyFrame: boolean; // 添加标志位跟踪是否等待key帧
 }
 
@@ -18,6 +19,8 @@ interface VideoDecoderInstance {
 class VideoDecoderManager {
     private static instance: VideoDecoderManager | null = null;
     private decoders: Record<string, VideoDecoderInstance> = {};
+    private codecs: Record<string, CodecIDType> = {}; // last codec seen per decoder key, kept across restarts
+    private sizes: Record<string, { width: number, height: number }> = {}; // last known frame size per decoder key
 
     private constructor() {
         console.log('[VideoOutputManager] Initialized');
@@ -38,9 +41,10 @@ class VideoDecoderManager {
      * 初始化视频解码器和MediaStreamTrackGenerator
      * @param peerIP peer IP 地址
      * @param trackID 轨道 ID
+     * @param codec 编码格式
      * @returns VideoDecoderInstance 或 null
      */
-    private initializeDecoderInstance(peerIP: string, trackID: TrackIDType): VideoDecoderInstance | null {
+    private initializeDecoderInstance(peerIP: string, trackID: TrackIDType, codec: CodecIDType): VideoDecoderInstance | null {
         const key = this.generateDecoderKey(peerIP, trackID);
 
         try {
@@ -63,10 +67,15 @@ class VideoDecoderManager {
                 }
             });
 
-            // 配置解码器 (VP09)
+            // 配置解码器, the peer's gateway picked the codec
             const config: VideoDecoderConfig = {
-                codec: 'vp09.00.41.08', // same as encoder
+                codec: CODEC_STRINGS[codec], // same as encoder
             };
+            const size = this.sizes[key];
+            if (size) {
+                config.codedWidth = size.width;
+                config.codedHeight = size.height;
+            }
             decoder.configure(config);
 
             const decoderInstance: VideoDecoderInstance = {
@@ -74,6 +83,7 @@ class VideoDecoderManager {
                 generator,
                 track,
                 writer,
+                codec,
                 waitingForKeyFrame: true // 新创建的解码器需要等待key帧
             };
 
@@ -92,7 +102,7 @@ class VideoDecoderManager {
             return this.decoders[key];
         }
 
-        const decoderInstance = this.initializeDecoderInstance(peerIP, trackID);
+        const decoderInstance = this.initializeDecoderInstance(peerIP, trackID, this.codecs[key] ?? CodecID.VP9);
         if (!decoderInstance) {
             console.error(`[VideoOutputManager] Failed to create decoder for ${key}`);
             return null;
@@ -134,9 +144,22 @@ class VideoDecoderManager {
      * 处理来自 WebSocket 的视频数据
      * @param peerIP 来源 peer 的 IP 地址
      * @param trackID 视频轨道 ID
+     * @param codec 编码格式
      * @param videoChunk 编码的视频数据块
+     * @param width 帧宽度, 0 when unknown
+     * @param height 帧高度, 0 when unknown
      */
-    public processVideoChunk(peerIP: string, trackID: TrackIDType, videoChunk: EncodedVideoChunk): void {
+    public processVideoChunk(peerIP: string, trackID: TrackIDType, codec: CodecIDType, videoChunk: EncodedVideoChunk, width = 0, height = 0): void {
+        const key = this.generateDecoderKey(peerIP, trackID);
+        this.codecs[key] = codec;
+        if (width > 0 && height > 0) {
+            this.sizes[key] = { width, height };
+        }
+        if (this.decoders[key] && this.decoders[key].codec !== codec) {
+            // the connection was rebuilt with another codec
+            this.restartDecoder(peerIP, trackID);
+        }
+
         const decoderInstance = this.getOrCreateDecoder(peerIP, trackID);
         if (!decoderInstance) {
             console.error(`[VideoOutputManager] Failed to get decoder for ${peerIP}-${trackID}`);
@@ -222,6 +245,8 @@ class VideoDecoderManager {
             const parts = key.split('-');
             const trackID = parseInt(parts[1]) as TrackIDType;
             this.removeDecoder(peerIP, trackID);
+            delete this.codecs[key];
+            delete this.sizes[key];
         });
 
         // 也从videoStreamStore中移除该peer的所有stream
@@ -242,6 +267,8 @@ class VideoDecoderManager {
             this.removeDecoder(peerIP, trackID);
         }
         this.decoders = {};
+        this.codecs = {};
+        this.sizes = {};
         console.log('[VideoOutputManager] All decoders cleaned up');
     }
 }
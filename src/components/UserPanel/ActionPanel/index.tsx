@@ -1,6 +1,6 @@
 import { useState } from "react"
 import { Button } from "@/components/ui/button"
-import { LogIn, LogOut, PhoneOff, Airplay, LoaderCircle, ChevronUp, ChevronDown } from 'lucide-react';
+import { LogIn, LogOut, PhoneOff, Airplay, LoaderCircle, ChevronUp, ChevronDown, Video, VideoOff } from 'lucide-react';
 import { Tooltip, TooltipContent, TooltipProvider, TooltipTrigger } from "@/components/ui/tooltip"
 import { DropdownMenu, DropdownMenuTrigger, DropdownMenuContent, DropdownMenuItem } from "@/components/ui/dropdown-menu"
 import { Dialog, DialogClose, DialogContent, DialogDescription, DialogFooter, DialogHeader, DialogTitle, DialogTrigger } from "@/components/ui/dialog"
@@ -46,8 +46,8 @@ const ActionPanel = () => {
         <TooltipProvider>
             <div className={`grid items-center space-x-2 transition-[grid-template-columns] duration-300 ease-in-out 
                 ${userState.isInChat ?
-                    userState.isSharingScreen ? 'grid-cols-[minmax(0,1fr)_minmax(0,1fr)]' : 'grid-cols-[minmax(0,1fr)_minmax(0,2fr)]'
-                    : 'grid-cols-[minmax(0,2fr)_minmax(0,0fr)]'}`}>
+                    userState.isSharingScreen ? 'grid-cols-[minmax(0,1fr)_minmax(0,1fr)_minmax(0,1fr)]' : 'grid-cols-[minmax(0,1fr)_minmax(0,2fr)_minmax(0,1fr)]'
+                    : 'grid-cols-[minmax(0,2fr)_minmax(0,0fr)_minmax(0,0fr)]'}`}>
                 <Tooltip>
                     <TooltipTrigger asChild>
                         <Button
@@ -144,6 +144,23 @@ const ActionPanel = () => {
 
                 </DropdownMenu>
 
+                <Tooltip>
+                    <TooltipTrigger asChild>
+                        <Button
+                            onClick={() => updateSelfState({ isSharingCamera: !userState.isSharingCamera })}
+                            variant="outline"
+                            className={`hover:!bg-neutral-500 cursor-pointer 
+                            ${userState.isSharingCamera ? '!bg-green-800 hover:!bg-red-600/60' : ''}
+                            ${userState.isInChat ? '' : 'hidden'}
+                            transition-all duration-300`}
+                        >
+                            {userState.isSharingCamera ? <VideoOff className="h-5 w-5" /> : <Video className="h-5 w-5" />}
+                        </Button>
+                    </TooltipTrigger>
+                    <TooltipContent>
+                        {userState.isSharingCamera ? <p>stop camera</p> : <p>start camera</p>}
+                    </TooltipContent>
+                </Tooltip>
 
             </div>
         </TooltipProvider >
@@ -0,0 +1,37 @@
+import { create } from 'zustand'
+
+
+interface CameraCaptureState {
+    stream: MediaStream | null
+
+    startCamera: () => Promise<MediaStream | null>
+    stopCamera: () => void
+}
+
+// the webcam stream, encoded as the camera track while isSharingCamera is set
+export const useCameraCapture = create<CameraCaptureState>((set, get) => ({
+    stream: null,
+    startCamera: async () => {
+        const { stream } = get()
+        if (stream) return stream
+
+        try {
+            const cameraStream = await navigator.mediaDevices.getUserMedia({
+                video: { width: { ideal: 1280 }, height: { ideal: 720 }, frameRate: { ideal: 30 } },
+                audio: false,
+            })
+            set({ stream: cameraStream })
+            return cameraStream
+        } catch (error) {
+            console.error('[camera] Failed to open the camera:', error)
+            return null
+        }
+    },
+    stopCamera: () => {
+        const { stream } = get()
+        if (!stream) return
+
+        stream.getTracks().forEach(track => track.stop())
+        set({ stream: null })
+    }
+}))
@@ -16,6 +16,8 @@ export * from './audioStore'
 
 export * from './screenShareStore'
 
+export * from './cameraStore'
+
 export * from './dmStore'
 
 export * from './localUserStateStore'
@@ -14,6 +14,7 @@ const defaultPeerState: PeerState = {
     isOutputMuted: false,
     isSharingScreen: false,
     isSharingAudio: false,
+    isSharingCamera: false,
 }
 
 interface LocalUserStateStore {
@@ -3,7 +3,7 @@ import { useRemoteUsersStore } from './remoteUsersStateStore';
 import { syncMirrorState } from './localUserStateStore';
 import { useDMStore } from './dmStore';
 import { useLatencyStore } from './latencyStore';
-import { PeerStateSchema, TrackID, type TrackIDType } from '@/types';
+import { PeerStateSchema, TrackID, type CodecIDType, type TrackIDType } from '@/types';
 import { AudioDecoderManager, VideoDecoderManager } from '@/MediaTrackManager';
 import { InputTrackManager } from '@/MediaTrackManager/input/InputTrackManager';
 import { useTailscaleStore } from './twgStore';
@@ -90,6 +90,7 @@ const createWs = (mediaWsAddr: string, msgWsAddr: string) => {
                     await handleAudioData(trackID, buffer);
                     break;
                 case TrackID.SCREEN_SHARE_VIDEO:
+                case TrackID.CAMERA_VIDEO:
                     await handleVideoData(trackID, buffer);
                     break;
                 default:
@@ -145,6 +146,9 @@ const handleWsMessage = (event: MessageEvent) => {
 
             case "rtc_status":
                 // console.log('rtc_status', msg);
+                if (Array.isArray(msg.screenCodecs)) {
+                    InputTrackManager.setScreenCodecs(msg.screenCodecs);
+                }
                 break;
             case "connection_state":
                 console.log('connection_state', msg);
@@ -162,6 +166,12 @@ const handleWsMessage = (event: MessageEvent) => {
                 console.log('BER', msg);
                 useLatencyStore.getState().updateTargetBitrates(msg.targetBitrates || {});
                 break;
+            case "requestKeyframe":
+                // console.log('requestKeyframe', msg);
+                if (typeof msg.trackID === 'number' && typeof msg.codec === 'number' && typeof msg.layer === 'number') {
+                    InputTrackManager.requestKeyframe(msg.trackID, msg.codec, msg.layer);
+                }
+                break;
             case "setAudioBitrate":
                 console.log('current microphone bitrate:', msg.bitrate);
                 break;
@@ -190,16 +200,57 @@ const handleWsMessage = (event: MessageEvent) => {
     }
 }
 
+const peerIDDecoder = new TextDecoder();
+
+// video frame header after the media header, see rtc_frames.go in the gateway
+const VIDEO_FRAME_HEADER_SIZE = 19;
+const CHUNK_FLAG_KEYFRAME = 1 << 0;
+
+interface VideoFrameHeader {
+    codec: CodecIDType;
+    isKeyFrame: boolean;
+    layer: number; // VP9 spatial layer
+    captureTime: number; // µs, the sender's RTP timestamp on the local clock
+    rtpTimestamp: number;
+    width: number; // 0 until the gateway has seen a keyframe it can read the size from
+    height: number;
+}
+
+const readVideoFrameHeader = (buffer: Uint8Array, offset: number): VideoFrameHeader | null => {
+    if (buffer.length <= offset + VIDEO_FRAME_HEADER_SIZE) return null;
+    const view = new DataView(buffer.buffer, buffer.byteOffset + offset, VIDEO_FRAME_HEADER_SIZE);
+    return {
+        codec: view.getUint8(0) as CodecIDType,
+        isKeyFrame: (view.getUint8(1) & CHUNK_FLAG_KEYFRAME) !== 0,
+        layer: view.getUint8(2),
+        captureTime: Number(view.getBigUint64(3, true)),
+        rtpTimestamp: view.getUint32(11, true),
+        width: view.getUint16(15, true),
+        height: view.getUint16(17, true),
+    };
+}
+
+// header: TrackID (1 byte) + peer ID length (1 byte) + peer ID (IPv4 or IPv6 address)
+const readMediaHeader = (buffer: Uint8Array): { peerIP: string, headerSize: number } | null => {
+    if (buffer.length < 2) return null;
+    const headerSize = 2 + buffer[1];
+    if (buffer.length <= headerSize) return null;
+
+    return {
+        peerIP: peerIDDecoder.decode(buffer.subarray(2, headerSize)),
+        headerSize,
+    };
+}
+
 // decode audio
 const handleAudioData = async (trackID: TrackIDType, buffer: Uint8Array) => {
-    const headerSize = 1 + 4; // TrackID (1 byte) + peerIP (4 bytes)
-    if (buffer.length <= headerSize) {
+    const header = readMediaHeader(buffer);
+    if (!header) {
         console.warn(`[Audio] Invalid audio data size for track ${trackID}: ${buffer.length}`);
         return;
     }
 
-    const peerIPBytes = buffer.slice(1, 5);
-    const peerIP = `${peerIPBytes[0]}.${peerIPBytes[1]}.${peerIPBytes[2]}.${peerIPBytes[3]}`;
+    const { peerIP, headerSize } = header;
     const opusData = buffer.slice(headerSize);
 
     try {
@@ -222,30 +273,30 @@ const handleAudioData = async (trackID: TrackIDType, buffer: Uint8Array) => {
 
 // decode video
 const handleVideoData = async (trackID: TrackIDType, buffer: Uint8Array) => {
-    const headerSize = 1 + 4; // TrackID (1 byte) + peerIP (4 bytes)
-    if (buffer.length <= headerSize) {
+    const header = readMediaHeader(buffer);
+    if (!header) {
         console.warn(`[Video] Invalid video data size for track ${trackID}: ${buffer.length}`);
         return;
     }
 
-    const peerIPBytes = buffer.slice(1, 5);
-    const peerIP = `${peerIPBytes[0]}.${peerIPBytes[1]}.${peerIPBytes[2]}.${peerIPBytes[3]}`;
-    const vp9Data = buffer.slice(headerSize);
+    const { peerIP, headerSize } = header;
+    const frame = readVideoFrameHeader(buffer, headerSize);
+    if (!frame) {
+        console.warn(`[Video] Invalid video data size for track ${trackID}: ${buffer.length}`);
+        return;
+    }
+    const videoData = buffer.slice(headerSize + VIDEO_FRAME_HEADER_SIZE);
 
     try {
-        // VP9 关键帧检测逻辑
-        // 检查第一个字节的第 3 位 (frame_type)，0 表示关键帧
-        const isKeyFrame = (vp9Data[0] & 0x08) === 0;
-
-        // 创建 EncodedVideoChunk 来解码
+        // 创建 EncodedVideoChunk 来解码, the gateway detects keyframes for every codec
         const chunk = new EncodedVideoChunk({
-            type: isKeyFrame ? 'key' : 'delta',
-            timestamp: performance.now() * 1000, // 转换为微秒
-            data: vp9Data
+            type: frame.isKeyFrame ? 'key' : 'delta',
+            timestamp: frame.captureTime, // 微秒
+            data: videoData
         });
 
         const outputManager = VideoDecoderManager.getInstance();
-        outputManager.processVideoChunk(peerIP, trackID, chunk);
+        outputManager.processVideoChunk(peerIP, trackID, frame.codec, chunk, frame.width, frame.height);
     } catch (error) {
         console.error(`[Video] Failed to create EncodedVideoChunk for track ${trackID} from ${peerIP}:`, error);
     }
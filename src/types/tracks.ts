@@ -1,7 +1,26 @@
 export const TrackID = {
     MICROPHONE_AUDIO: 0,
     CPA_AUDIO: 1,
-    SCREEN_SHARE_VIDEO: 2
+    SCREEN_SHARE_VIDEO: 2,
+    CAMERA_VIDEO: 3
 } as const;
 
 export type TrackIDType = typeof TrackID[keyof typeof TrackID];
+
+// codec IDs carried in video chunks, same as CODEC_* in the gateway
+export const CodecID = {
+    VP9: 0,
+    H264: 1,
+    AV1: 2,
+    VP8: 3
+} as const;
+
+export type CodecIDType = typeof CodecID[keyof typeof CodecID];
+
+// WebCodecs codec strings, encoder and decoder use the same
+export const CODEC_STRINGS: Record<CodecIDType, string> = {
+    [CodecID.VP9]: 'vp09.00.41.08',
+    [CodecID.H264]: 'avc1.42E033', // constrained baseline, the profile WebRTC peers expect
+    [CodecID.AV1]: 'av01.0.08M.08',
+    [CodecID.VP8]: 'vp8',
+};
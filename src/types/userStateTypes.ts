@@ -8,6 +8,7 @@ const PeerStateSchema = z.object({
     isOutputMuted: z.boolean(),
     isSharingScreen: z.boolean(),
     isSharingAudio: z.boolean(),
+    isSharingCamera: z.boolean().default(false), // older gateways don't send it
 });
 
 // 从 schema 推导出 TypeScript 类型
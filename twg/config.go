@@ -4,6 +4,8 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -20,6 +22,15 @@ func InitConfig() (string, string, string, string, bool) {
 	cliControlURLPtr := flag.String("controlurl", "", "Tailscale control server URL")
 	cliDirPathPtr := flag.String("dirpath", "", "Path to directory")
 	cliEphemeralPtr := flag.Bool("ephemeral", false, "Run Tailscale node in ephemeral mode")
+	cliAccessControlPtr := flag.Bool("access-control", false, "Enforce the roles of the relayx app capability, without it the capability is ignored and every peer can join")
+	cliMetricsTailnetPtr := flag.Bool("metrics-tailnet", false, "Also serve /metrics to tailnet peers granted the relayx metrics capability")
+	cliLazyMeshPtr := flag.Bool("lazy-mesh", false, "Only connect to peers when one side is in chat")
+	cliPresenceIntervalPtr := flag.Duration("presence-interval", 0, "Presence heartbeat interval while in chat (default 2s)")
+	cliDiscoveryTagsPtr := flag.String("discovery-tags", "", "Comma separated tags of nodes to send presence to, e.g. tag:relayx")
+	cliDiscoveryHostnamesPtr := flag.String("discovery-hostnames", "", "Comma separated hostname patterns of nodes to send presence to, e.g. relayx-*")
+	cliNoDiscoveryProbePtr := flag.Bool("no-discovery-probe", false, "Don't probe other tailnet nodes for relayx")
+	cliPresenceIdlePtr := flag.Duration("presence-idle-interval", 0, "Presence heartbeat interval while idle (default 10s)")
+	cliScreenCodecsPtr := flag.String("screen-codecs", "", "Comma separated screen share codecs in order of preference, of vp9, h264 and av1 (default vp9,h264,av1)")
 	flag.Parse()
 
 	// Load .env file only if explicitly specified
@@ -96,6 +107,51 @@ func InitConfig() (string, string, string, string, bool) {
 		log.Printf("Using default directory path: %s", finalDirPath)
 	}
 
+	// Access control
+	if *cliAccessControlPtr || os.Getenv("RELAYX_ACCESS_CONTROL") == "1" {
+		accessControl = true
+		log.Printf("Access control enabled, peers need the %s capability", relayxCapability)
+	}
+
+	// Metrics
+	if *cliMetricsTailnetPtr || os.Getenv("RELAYX_METRICS_TAILNET") == "1" {
+		metricsOnTailnet = true
+		log.Printf("Serving /metrics on the tailnet listener to peers with the %s capability", relayxMetricsCapability)
+	}
+
+	// Lazy mesh
+	if *cliLazyMeshPtr || os.Getenv("RELAYX_LAZY_MESH") == "1" {
+		lazyMesh = true
+		log.Printf("Lazy mesh enabled, idle peers are not connected")
+	}
+
+	// Presence intervals
+	if interval := durationSetting(*cliPresenceIntervalPtr, "RELAYX_PRESENCE_INTERVAL"); interval > 0 {
+		broadcastInterval = interval
+		log.Printf("Using presence interval: %v", broadcastInterval)
+	}
+	if interval := durationSetting(*cliPresenceIdlePtr, "RELAYX_PRESENCE_IDLE_INTERVAL"); interval > 0 {
+		presenceIdleInterval = interval
+		log.Printf("Using idle presence interval: %v", presenceIdleInterval)
+	}
+	if presenceIdleInterval < broadcastInterval {
+		presenceIdleInterval = broadcastInterval
+	}
+
+	// Discovery scope
+	discoveryTags = listSetting(*cliDiscoveryTagsPtr, "RELAYX_DISCOVERY_TAGS")
+	discoveryHostnames = listSetting(*cliDiscoveryHostnamesPtr, "RELAYX_DISCOVERY_HOSTNAMES")
+	if *cliNoDiscoveryProbePtr || os.Getenv("RELAYX_DISCOVERY_PROBE") == "0" {
+		discoveryProbe = false
+	}
+	log.Printf("Discovery: tags=%v, hostnames=%v, probe=%t", discoveryTags, discoveryHostnames, discoveryProbe)
+
+	// Screen share codecs
+	if names := listSetting(*cliScreenCodecsPtr, "RELAYX_SCREEN_CODECS"); len(names) > 0 {
+		setScreenCodecs(names)
+	}
+	log.Printf("Screen share codecs: %v", screenCodecs)
+
 	// Validation
 	if finalHostname == "" {
 		osHostname, err := os.Hostname()
@@ -112,3 +168,36 @@ func InitConfig() (string, string, string, string, bool) {
 
 	return finalHostname, finalControlURL, finalAuthKey, finalDirPath, *cliEphemeralPtr
 }
+
+// durationSetting returns the flag value if set, else the parsed environment variable
+func durationSetting(flagValue time.Duration, envName string) time.Duration {
+	if flagValue > 0 {
+		return flagValue
+	}
+	envValue := os.Getenv(envName)
+	if envValue == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(envValue)
+	if err != nil {
+		log.Printf("Ignoring invalid %s %q: %v", envName, envValue, err)
+		return 0
+	}
+	return d
+}
+
+// listSetting splits the flag value if set, else the environment variable, on commas
+func listSetting(flagValue string, envName string) []string {
+	value := flagValue
+	if value == "" {
+		value = os.Getenv(envName)
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
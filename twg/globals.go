@@ -11,15 +11,28 @@ import (
 )
 
 type NodeInfo struct {
-	Hostname    string `json:"hostname"`
-	StartTime   int64  `json:"start_time"`
-	RandomID    uint64 `json:"random_id"`
-	TailscaleIP string `json:"tailscale_ip"`
+	Hostname        string   `json:"hostname"`
+	StartTime       int64    `json:"start_time"`
+	RandomID        uint64   `json:"random_id"`
+	TailscaleIP     string   `json:"tailscale_ip"`
+	TrickleICE      bool     `json:"trickle_ice,omitempty"`      // older builds omit this and only accept bundled ICE
+	ProtocolVersion int      `json:"protocol_version,omitempty"` // 0 for builds before versioning
+	Codecs          []string `json:"codecs,omitempty"`
+	TrackKinds      []string `json:"track_kinds,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	PresenceKey     []byte   `json:"presence_key,omitempty"`  // ed25519 public key signing presence packets
+	TailscaleIPs    []string `json:"tailscale_ips,omitempty"` // every address, TailscaleIP is the preferred one
 }
 
 type OnlinePeerData struct {
-	NodeInfo  NodeInfo `json:"node_info"`
-	Timestamp int64    `json:"timestamp"`
+	NodeInfo  NodeInfo      `json:"node_info"`
+	Timestamp int64         `json:"timestamp"`
+	Seq       uint64        `json:"seq,omitempty"`   // strictly increasing per presence key, signed packets only
+	State     *StateSummary `json:"state,omitempty"` // missing from builds before state summaries
+
+	IntervalMs int64     `json:"interval_ms,omitempty"` // sender's time until its next heartbeat
+	Leaving    bool      `json:"leaving,omitempty"`     // sent once on graceful shutdown
+	receivedAt time.Time // local clock, set on receive
 }
 
 type PeerState struct {
@@ -30,6 +43,9 @@ type PeerState struct {
 	IsOutputMuted   bool   `json:"isOutputMuted"`
 	IsSharingScreen bool   `json:"isSharingScreen"`
 	IsSharingAudio  bool   `json:"isSharingAudio"`
+	IsSharingCamera bool   `json:"isSharingCamera"`
+	Room            string `json:"room,omitempty"`
+	RoomSince       int64  `json:"roomSince,omitempty"` // unix ms the node entered Room, on its own clock
 }
 
 var (
@@ -37,6 +53,10 @@ var (
 	tcpPort           = "8848"
 	broadcastInterval = 2 * time.Second
 	HTTP_TIMEOUT      = 10 * time.Second
+	trickleICE        = true  // send ICE candidates one by one to peers that support it
+	accessControl     = false // enforce relayx app capabilities from the tailnet policy
+	metricsOnTailnet  = false // also serve /metrics on the tsnet listener
+	lazyMesh          = false // only connect to peers when one side is in chat
 	authKey           string
 	hostname          string
 	controlURL        string
@@ -48,4 +68,5 @@ var (
 	mirrorState       PeerState
 	mirrorStateMu     sync.RWMutex
 	peerPingManager   *PeerPingManager
+	peerAccessManager *PeerAccessManager
 )
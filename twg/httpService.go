@@ -6,9 +6,11 @@ import (
 	"log"
 	"net"
 	"net/http"
+
+	"tailscale.com/client/local"
 )
 
-func initHttpService(ln net.Listener, ready chan<- struct{}) {
+func initHttpService(ln net.Listener, lc *local.Client, ready chan<- struct{}) {
 	var err error
 	var ip = nodeInfo.TailscaleIP
 
@@ -28,17 +30,48 @@ func initHttpService(ln net.Listener, ready chan<- struct{}) {
 		}
 	}
 
+	// signaling requests must come from the node they claim to be from
+	authenticate := func(w http.ResponseWriter, r *http.Request, from string) (*PeerIdentity, bool) {
+		who, status, err := authenticatePeer(lc, r, from)
+		if err != nil {
+			log.Printf("Rejected %s request from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			result := SignalingResult{Status: SIGNALING_UNAUTHORIZED, Error: err.Error()}
+			switch status {
+			case http.StatusBadRequest:
+				result.Status = SIGNALING_BAD_REQUEST
+			case http.StatusInternalServerError:
+				result.Status = SIGNALING_INTERNAL_ERROR
+			}
+			writeSignalingResult(w, status, result)
+			return nil, false
+		}
+
+		access := accessFromWhoIs(who)
+		if peerAccessManager != nil {
+			peerAccessManager.store(from, access)
+		}
+		if !access.canConnect() {
+			log.Printf("Rejected %s request from %s: no %s capability", r.URL.Path, from, relayxCapability)
+			writeSignalingResult(w, http.StatusForbidden, SignalingResult{Status: SIGNALING_UNAUTHORIZED, Error: "missing " + string(relayxCapability)})
+			return nil, false
+		}
+		return identityFromWhoIs(who), true
+	}
+
 	mux.HandleFunc("/", corsHandler(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(nodeInfo)
 	}))
 
+	if metricsOnTailnet {
+		mux.HandleFunc("/metrics", tailnetMetricsHandler(lc))
+	}
+
 	mux.HandleFunc("/offer_ice", corsHandler(func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
 			log.Printf("Error reading request body for /offer_ice: %v", err)
-
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			writeSignalingResult(w, http.StatusInternalServerError, SignalingResult{Status: SIGNALING_INTERNAL_ERROR, Error: "failed to read request body"})
 			return
 		}
 		defer r.Body.Close()
@@ -46,27 +79,31 @@ func initHttpService(ln net.Listener, ready chan<- struct{}) {
 		var offerData HTTPpayload
 		if err := json.Unmarshal(bodyBytes, &offerData); err != nil {
 			log.Printf("Error parsing JSON from /offer_ice: %v", err)
-			http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+			writeSignalingResult(w, http.StatusBadRequest, SignalingResult{Status: SIGNALING_BAD_REQUEST, Error: "failed to parse JSON"})
 			return
 		}
 		// fmt.Printf("[HTTP] /offer_ice RECEIVED: %v\n", offerData)
 
-		go rtcManager.createConnection(
-			ANSWER,
-			offerData.From,
-			&offerData.SDPWithICE,
-		)
+		identity, ok := authenticate(w, r, offerData.From)
+		if !ok {
+			return
+		}
+		offerData.Identity = identity
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(""))
+		if err := rtcManager.HandleOffer(&offerData); err != nil {
+			log.Printf("Rejected offer from %s: %v", offerData.From, err)
+			writeSignalingError(w, err)
+			return
+		}
+
+		writeSignalingAccepted(w)
 	}))
 
 	mux.HandleFunc("/answer_ice", corsHandler(func(w http.ResponseWriter, r *http.Request) {
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Error reading request body for /offer_ice: %v", err)
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			log.Printf("Error reading request body for /answer_ice: %v", err)
+			writeSignalingResult(w, http.StatusInternalServerError, SignalingResult{Status: SIGNALING_INTERNAL_ERROR, Error: "failed to read request body"})
 			return
 		}
 		defer r.Body.Close()
@@ -74,22 +111,85 @@ func initHttpService(ln net.Listener, ready chan<- struct{}) {
 		var answerData HTTPpayload
 		if err := json.Unmarshal(bodyBytes, &answerData); err != nil {
 			log.Printf("Error parsing JSON from /answer_ice: %v", err)
-			http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+			writeSignalingResult(w, http.StatusBadRequest, SignalingResult{Status: SIGNALING_BAD_REQUEST, Error: "failed to parse JSON"})
 			return
 		}
 		// fmt.Printf("[HTTP] /answer_ice RECEIVED: %v\n", answerData)
 
-		go func() {
-			if err := rtcManager.HandleAnswer(answerData.From, &answerData.SDPWithICE); err != nil {
-				log.Printf("Error handling answer for %s: %v", answerData.From, err)
-				http.Error(w, "Failed to handle answer", http.StatusInternalServerError)
-				return
-			}
-		}()
+		identity, ok := authenticate(w, r, answerData.From)
+		if !ok {
+			return
+		}
+		answerData.Identity = identity
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(""))
+		if err := rtcManager.HandleAnswer(answerData.From, &answerData); err != nil {
+			log.Printf("Error handling answer for %s: %v", answerData.From, err)
+			writeSignalingError(w, err)
+			return
+		}
+
+		writeSignalingAccepted(w)
+	}))
+
+	mux.HandleFunc("/ice_candidate", corsHandler(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading request body for /ice_candidate: %v", err)
+			writeSignalingResult(w, http.StatusInternalServerError, SignalingResult{Status: SIGNALING_INTERNAL_ERROR, Error: "failed to read request body"})
+			return
+		}
+		defer r.Body.Close()
+
+		var candidateData ICECandidatePayload
+		if err := json.Unmarshal(bodyBytes, &candidateData); err != nil {
+			log.Printf("Error parsing JSON from /ice_candidate: %v", err)
+			writeSignalingResult(w, http.StatusBadRequest, SignalingResult{Status: SIGNALING_BAD_REQUEST, Error: "failed to parse JSON"})
+			return
+		}
+
+		if _, ok := authenticate(w, r, candidateData.From); !ok {
+			return
+		}
+
+		if err := rtcManager.HandleRemoteCandidate(candidateData); err != nil {
+			log.Printf("Error handling ICE candidate from %s: %v", candidateData.From, err)
+			writeSignalingError(w, err)
+			return
+		}
+
+		writeSignalingAccepted(w)
+	}))
+
+	mux.HandleFunc("/renegotiate", corsHandler(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("Error reading request body for /renegotiate: %v", err)
+			writeSignalingResult(w, http.StatusInternalServerError, SignalingResult{Status: SIGNALING_INTERNAL_ERROR, Error: "failed to read request body"})
+			return
+		}
+		defer r.Body.Close()
+
+		var offerData HTTPpayload
+		if err := json.Unmarshal(bodyBytes, &offerData); err != nil {
+			log.Printf("Error parsing JSON from /renegotiate: %v", err)
+			writeSignalingResult(w, http.StatusBadRequest, SignalingResult{Status: SIGNALING_BAD_REQUEST, Error: "failed to parse JSON"})
+			return
+		}
+
+		identity, ok := authenticate(w, r, offerData.From)
+		if !ok {
+			return
+		}
+		offerData.Identity = identity
+
+		answer, err := rtcManager.HandleRenegotiation(&offerData)
+		if err != nil {
+			log.Printf("Error handling renegotiation from %s: %v", offerData.From, err)
+			writeSignalingError(w, err)
+			return
+		}
+
+		writeSignalingResult(w, http.StatusOK, SignalingResult{Status: SIGNALING_ACCEPTED, Answer: answer})
 	}))
 
 	log.Printf("HTTP server starting on %s (%s:%s)", ln.Addr().String(), ip, tcpPort)
@@ -57,10 +57,10 @@ func main() {
 	_ = controlURL
 
 	httpReady := make(chan struct{})
-	initHttpService(result.httpListener, httpReady)
+	initHttpService(result.httpListener, result.lc, httpReady)
 	<-httpReady
 
-	go startOnlineBroadcast(result.udpConn, result.lc)
+	go startOnlineBroadcast(result.udpConn, result.lc, result.httpClient)
 
 	go initWebRTC(result.rtcConn, result.httpClient)
 
@@ -70,6 +70,8 @@ func main() {
 
 	<-sigChan
 
+	sayGoodbye()
+
 	// clean
 	if result.udpConn != nil {
 		result.udpConn.Close()
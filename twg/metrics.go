@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// prometheus metrics in the text exposition format. counters are updated on
+// the hot paths, gauges are read from rtcManager when /metrics is scraped.
+// /metrics is served on the local ws server, and on the tsnet listener when
+// enabled with --metrics-tailnet or RELAYX_METRICS_TAILNET=1. on the tailnet
+// only peers granted relayxMetricsCapability get it, whatever --access-control
+// says, the per-peer gauges name every peer this node talks to.
+
+// counterVec is a counter with one label
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]*atomic.Uint64),
+	}
+}
+
+func (c *counterVec) add(labelValue string, n uint64) {
+	c.mu.RLock()
+	value, exists := c.values[labelValue]
+	c.mu.RUnlock()
+
+	if !exists {
+		c.mu.Lock()
+		if value, exists = c.values[labelValue]; !exists {
+			value = &atomic.Uint64{}
+			c.values[labelValue] = value
+		}
+		c.mu.Unlock()
+	}
+	value.Add(n)
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.RLock()
+	samples := make(map[string]float64, len(c.values))
+	for labelValue, value := range c.values {
+		samples[labelValue] = float64(value.Load())
+	}
+	c.mu.RUnlock()
+
+	writeMetric(w, c.name, c.help, "counter", c.label, samples)
+}
+
+var (
+	metricMediaChunksIn = newCounterVec("relayx_media_chunks_in_total",
+		"Media chunks received from the local frontend.", "track")
+	metricMediaChunksOut = newCounterVec("relayx_media_chunks_out_total",
+		"Media chunks received from peers and sent to the local frontend.", "track")
+	metricDroppedFrames = newCounterVec("relayx_dropped_frames_total",
+		"Media frames dropped before reaching a peer or the frontend.", "reason")
+	metricDataChannelMessages = newCounterVec("relayx_datachannel_messages_total",
+		"Data channel messages by direction.", "direction")
+	metricPresencePackets = newCounterVec("relayx_presence_packets_total",
+		"Presence packets by direction.", "direction")
+	metricPresenceDropped = newCounterVec("relayx_presence_dropped_total",
+		"Received presence packets that failed verification.", "reason")
+	metricDiscoveryProbes = newCounterVec("relayx_discovery_probes_total",
+		"Discovery checks of tailnet nodes by result.", "result")
+	metricKeyframeRequests = newCounterVec("relayx_keyframe_requests_total",
+		"Keyframe requests sent to the frontend by reason, and PLIs sent to peers.", "reason")
+)
+
+var counters = []*counterVec{
+	metricMediaChunksIn,
+	metricMediaChunksOut,
+	metricDroppedFrames,
+	metricDataChannelMessages,
+	metricPresencePackets,
+	metricPresenceDropped,
+	metricDiscoveryProbes,
+	metricKeyframeRequests,
+}
+
+// trackLabel names a media track for metric labels
+func trackLabel(trackID uint8) string {
+	if t, exists := trackMap[trackID]; exists {
+		return t.id
+	}
+	return "unknown"
+}
+
+func writeMetric(w io.Writer, name string, help string, kind string, label string, samples map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+
+	labelValues := make([]string, 0, len(samples))
+	for labelValue := range samples {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", name, label, labelValue, samples[labelValue])
+	}
+}
+
+// writeConnectionMetrics reads the gauges from the current connections
+func writeConnectionMetrics(w io.Writer) {
+	states := make(map[string]float64)
+	latencies := make(map[string]float64)
+	bitrates := make(map[string]float64)
+
+	if rtcManager != nil {
+		rtcManager.mu.RLock()
+		for peerIP, connection := range rtcManager.connections {
+			states[connection.pc.ConnectionState().String()]++
+
+			connection.pingMu.RLock()
+			if connection.latency > 0 {
+				latencies[peerIP] = connection.latency.Seconds()
+			}
+			connection.pingMu.RUnlock()
+		}
+		rtcManager.mu.RUnlock()
+
+		rtcManager.estimatorsMu.RLock()
+		for peerIP, estimator := range rtcManager.estimators {
+			if estimator != nil {
+				bitrates[peerIP] = float64(estimator.GetTargetBitrate())
+			}
+		}
+		rtcManager.estimatorsMu.RUnlock()
+	}
+
+	onlinePeersMu.RLock()
+	onlineCount := len(onlinePeers)
+	onlinePeersMu.RUnlock()
+
+	writeMetric(w, "relayx_rtc_connections", "WebRTC connections by connection state.", "gauge", "state", states)
+	writeMetric(w, "relayx_rtc_peer_latency_seconds", "Data channel ping round trip time per peer.", "gauge", "peer", latencies)
+	writeMetric(w, "relayx_gcc_target_bitrate_bps", "GCC target bitrate per peer.", "gauge", "peer", bitrates)
+	fmt.Fprintf(w, "# HELP relayx_online_peers Peers currently announcing presence.\n# TYPE relayx_online_peers gauge\nrelayx_online_peers %d\n", onlineCount)
+	fmt.Fprintf(w, "# HELP relayx_uptime_seconds Seconds since the node started.\n# TYPE relayx_uptime_seconds gauge\nrelayx_uptime_seconds %d\n", time.Now().Unix()-nodeInfo.StartTime)
+}
+
+// metricsAllowed reports whether a tailnet peer may scrape /metrics
+func metricsAllowed(who *apitype.WhoIsResponse) bool {
+	return who != nil && who.Node != nil && who.CapMap.HasCapability(relayxMetricsCapability)
+}
+
+// tailnetMetricsHandler is metricsHandler for peers that pass metricsAllowed
+func tailnetMetricsHandler(lc *local.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil && !errors.Is(err, local.ErrPeerNotFound) {
+			log.Printf("[metrics] whois %s: %v", r.RemoteAddr, err)
+			http.Error(w, "whois failed", http.StatusInternalServerError)
+			return
+		}
+		if !metricsAllowed(who) {
+			log.Printf("[metrics] Rejected scrape from %s: no %s capability", r.RemoteAddr, relayxMetricsCapability)
+			http.Error(w, "missing "+string(relayxMetricsCapability), http.StatusForbidden)
+			return
+		}
+		metricsHandler(w, r)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeConnectionMetrics(w)
+	for _, counter := range counters {
+		counter.write(w)
+	}
+}
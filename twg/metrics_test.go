@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestMetricsAllowed(t *testing.T) {
+	node := &tailcfg.Node{Name: "scraper.tailnet.ts.net."}
+	tests := []struct {
+		name string
+		who  *apitype.WhoIsResponse
+		want bool
+	}{
+		{"unknown peer", nil, false},
+		{"no node", &apitype.WhoIsResponse{CapMap: tailcfg.PeerCapMap{relayxMetricsCapability: nil}}, false},
+		{"no capability", &apitype.WhoIsResponse{Node: node}, false},
+		{"join only", &apitype.WhoIsResponse{Node: node, CapMap: tailcfg.PeerCapMap{relayxCapability: nil}}, false},
+		{"granted", &apitype.WhoIsResponse{Node: node, CapMap: tailcfg.PeerCapMap{relayxMetricsCapability: nil}}, true},
+	}
+	for _, tt := range tests {
+		if got := metricsAllowed(tt.who); got != tt.want {
+			t.Errorf("%s: metricsAllowed = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
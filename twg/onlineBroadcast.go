@@ -7,6 +7,7 @@ import (
 	"log"
 	"maps"
 	"net"
+	"net/http"
 	"time"
 
 	"tailscale.com/client/local"
@@ -14,71 +15,71 @@ import (
 )
 
 // startOnlineBroadcast 启动UDP在线消息广播
-func startOnlineBroadcast(conn net.PacketConn, lc *local.Client) {
+func startOnlineBroadcast(conn net.PacketConn, lc *local.Client, client *http.Client) {
 	initOnlinePeers()
 
-	go startUDPListener(conn)
+	ctx := context.Background()
+	go startUDPListener(conn, newPresenceVerifier(lc, ctx))
 
-	ticker := time.NewTicker(broadcastInterval)
-	defer ticker.Stop()
+	presenceScheduler = newPresenceScheduler(conn, lc, ctx, newDiscoveryManager(lc, ctx, client))
+	presenceScheduler.run()
+}
 
-	for range ticker.C {
-		broadcastToOnlinePeers(conn, lc)
+// broadcast 向所有在线的peer发送UDP广播消息, heartbeat is the announced time until the next one
+func (ps *PresenceScheduler) broadcast(heartbeat time.Duration) {
+	targets := ps.peerTargets()
+	if len(targets) == 0 {
+		return
 	}
-}
 
-// broadcastToOnlinePeers 向所有在线的peer发送UDP广播消息
-func broadcastToOnlinePeers(sendConn net.PacketConn, lc *local.Client) {
-	ctx := context.Background()
-	status, err := lc.Status(ctx)
+	packets, err := presencePacket(heartbeat)
 	if err != nil {
-		log.Printf("Failed to get status: %v", err)
 		return
 	}
 
-	if status.BackendState != "Running" {
-		log.Printf("Backend not running, current state: %s", status.BackendState)
-		return
+	for _, peerIP := range targets {
+		sendUDPMessage(ps.conn, peerIP, string(packets.forPeer(peerIP)))
 	}
+}
 
+func presencePacket(heartbeat time.Duration) (presencePackets, error) {
 	broadcastData := OnlinePeerData{
-		NodeInfo:  nodeInfo,
-		Timestamp: time.Now().UTC().Unix(),
+		NodeInfo:   nodeInfo,
+		Timestamp:  time.Now().UTC().Unix(),
+		State:      localStateSummary(),
+		IntervalMs: heartbeat.Milliseconds(),
 	}
 
-	messageBytes, err := json.Marshal(broadcastData)
+	packets, err := signPresence(broadcastData)
 	if err != nil {
 		log.Printf("Failed to marshal broadcast data: %v", err)
-		return
-	}
-
-	// 获取所有在线的peer
-	for _, peer := range status.Peer {
-		if peer.Online && len(peer.TailscaleIPs) > 0 {
-			peerIP := peer.TailscaleIPs[0].String()
-			go sendUDPMessage(sendConn, peerIP, string(messageBytes))
-		}
 	}
+	return packets, err
 }
 
-// sendUDPMessage 向指定peer发送UDP消息
+// sendUDPMessage 向指定peer发送UDP消息, to its preferred address, the
+// others are only tried when sending there fails
 func sendUDPMessage(conn net.PacketConn, peerIP string, message string) {
-	targetAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(peerIP, udpPort))
-	if err != nil {
-		log.Printf("Failed to resolve UDP address for %s: %v", peerIP, err)
-		return
-	}
+	for _, addr := range peerAddrs(peerIP) {
+		targetAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, udpPort))
+		if err != nil {
+			log.Printf("Failed to resolve UDP address for %s: %v", addr, err)
+			continue
+		}
 
-	_, err = conn.WriteTo([]byte(message), targetAddr)
-	if err != nil {
-		log.Printf("Failed to send UDP message to %s: %v", peerIP, err)
+		_, err = conn.WriteTo([]byte(message), targetAddr)
+		if err != nil {
+			log.Printf("Failed to send UDP message to %s: %v", addr, err)
+			continue
+		}
+		metricPresencePackets.inc("out")
 		return
 	}
 }
 
 // startUDPListener 启动UDP监听器来接收广播消息
-func startUDPListener(conn net.PacketConn) {
-	buffer := make([]byte, 1024)
+func startUDPListener(conn net.PacketConn, verifier *PresenceVerifier) {
+	buffer := make([]byte, 4096)
 	for {
 		n, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
@@ -90,12 +91,13 @@ func startUDPListener(conn net.PacketConn) {
 			continue
 		}
 
-		// parse json
-		var receivedData OnlinePeerData
-		if err := json.Unmarshal(buffer[:n], &receivedData); err != nil {
-			log.Printf("Failed to unmarshal UDP message from %s: %v", addr.String(), err)
+		receivedData, err := verifier.verify(buffer[:n], addr)
+		if err != nil {
+			log.Printf("Dropped presence packet from %s: %v", addr.String(), err)
+			metricPresenceDropped.inc(dropReason(err))
 			continue
 		}
+		metricPresencePackets.inc("in")
 
 		updateOnlinePeer(receivedData)
 	}
@@ -103,10 +105,29 @@ func startUDPListener(conn net.PacketConn) {
 
 // data includes key
 func updateOnlinePeer(data OnlinePeerData) {
-	onlinePeersMu.Lock()
-	defer onlinePeersMu.Unlock()
+	if data.Leaving {
+		removeLeavingPeer(data.NodeInfo.TailscaleIP, "presence")
+		return
+	}
+	data.receivedAt = time.Now()
+	if addrs := parseAddrs(data.NodeInfo.TailscaleIPs); len(addrs) > 0 {
+		// verified to belong to the node, older builds only send TailscaleIP
+		notePeerAddrs(addrs)
+	}
 
+	onlinePeersMu.Lock()
+	_, known := onlinePeers[data.NodeInfo.TailscaleIP]
 	onlinePeers[data.NodeInfo.TailscaleIP] = data
+	onlinePeersMu.Unlock()
+
+	if !known && presenceScheduler != nil {
+		// let the new peer see us without waiting for our next heartbeat
+		go presenceScheduler.announceTo(data.NodeInfo.TailscaleIP)
+	}
+
+	if data.NodeInfo.TailscaleIP != nodeInfo.TailscaleIP {
+		checkPeerVersion(data.NodeInfo.TailscaleIP, data.NodeInfo)
+	}
 }
 
 func initOnlinePeers() {
@@ -152,15 +173,14 @@ func reportOnlinePeersLoop() {
 }
 
 func cleanupExpiredPeersLoop() {
-	ticker := time.NewTicker(broadcastInterval)
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		onlinePeersMu.Lock()
-		currentTime := time.Now().UTC().Unix()
 		for ip, peerData := range onlinePeers {
-			// remove peer if not receiving update for more than 10 seconds
-			if currentTime-peerData.Timestamp > 10 {
+			// measured on the local clock, the sender's timestamp may be skewed
+			if time.Since(peerData.receivedAt) > peerExpiry(peerData) {
 				delete(onlinePeers, ip)
 			}
 		}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// discovery scoping: presence only goes to tailnet nodes known or likely to
+// run relayx. a node qualifies when it already sent us presence, carries one
+// of the --discovery-tags, has a hostname matching --discovery-hostnames, has
+// the relayx node attribute, or answers the NodeInfo probe on /. nodes that
+// fail the probe are checked again with backoff. the node attribute is set on
+// the relayx nodes themselves in the policy file, e.g.
+//
+//	"nodeAttrs": [{"target": ["tag:relayx"], "attr": ["relayx.example/node"]}]
+//
+// entries of nodes that went offline or left the tailnet are dropped on every
+// pass, so they are probed again when they come back.
+
+const relayxNodeAttr tailcfg.NodeCapability = "relayx.example/node"
+
+var (
+	discoveryTags      []string // e.g. tag:relayx
+	discoveryHostnames []string // path.Match patterns, e.g. relayx-*
+	discoveryProbe     = true
+
+	discoveryProbeTimeout = 3 * time.Second
+	discoveryMinBackoff   = 1 * time.Minute
+	discoveryMaxBackoff   = 30 * time.Minute
+	discoveryTrustTTL     = 10 * time.Minute // a positive probe is repeated after this
+)
+
+type discoveryEntry struct {
+	relayx    bool
+	checkedAt time.Time
+	backoff   time.Duration
+	probing   bool
+}
+
+// the DiscoveryManager remembers which tailnet nodes run relayx
+type DiscoveryManager struct {
+	lc     *local.Client
+	ctx    context.Context
+	client *http.Client
+	peers  map[string]*discoveryEntry // key is peerIP
+	mu     sync.Mutex
+}
+
+func newDiscoveryManager(lc *local.Client, ctx context.Context, client *http.Client) *DiscoveryManager {
+	return &DiscoveryManager{
+		lc:     lc,
+		ctx:    ctx,
+		client: client,
+		peers:  make(map[string]*discoveryEntry),
+	}
+}
+
+// matchesScope checks the node attribute, the configured tags and hostname patterns
+func matchesScope(peer *ipnstate.PeerStatus) bool {
+	if peer.HasCap(relayxNodeAttr) {
+		return true
+	}
+	if peer.Tags != nil {
+		for _, tag := range peer.Tags.All() {
+			for _, want := range discoveryTags {
+				if tag == want {
+					return true
+				}
+			}
+		}
+	}
+
+	shortName, _, _ := strings.Cut(peer.DNSName, ".")
+	for _, pattern := range discoveryHostnames {
+		for _, name := range []string{peer.HostName, shortName} {
+			if matched, _ := path.Match(pattern, name); matched && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filter returns the addresses of the online peers presence should go to,
+// and starts probes for the ones that are due
+func (dm *DiscoveryManager) filter(peers []*ipnstate.PeerStatus) []string {
+	onlinePeersMu.RLock()
+	known := make(map[string]bool, len(onlinePeers))
+	for peerIP := range onlinePeers {
+		known[peerIP] = true
+	}
+	onlinePeersMu.RUnlock()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	var targets []string
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if !peer.Online || len(peer.TailscaleIPs) == 0 {
+			continue
+		}
+		peerIP := notePeerAddrs(peer.TailscaleIPs)
+		seen[peerIP] = true
+
+		entry, exists := dm.peers[peerIP]
+		if !exists {
+			entry = &discoveryEntry{backoff: discoveryMinBackoff}
+			dm.peers[peerIP] = entry
+		}
+
+		if known[peerIP] || matchesScope(peer) || entry.relayx {
+			targets = append(targets, peerIP)
+		}
+
+		due := entry.checkedAt.IsZero() || time.Since(entry.checkedAt) > entry.backoff
+		if entry.relayx {
+			due = time.Since(entry.checkedAt) > discoveryTrustTTL
+		}
+		if due && discoveryProbe && !entry.probing && !known[peerIP] {
+			entry.probing = true
+			go dm.probe(peerIP)
+		}
+	}
+
+	for peerIP := range dm.peers {
+		if !seen[peerIP] {
+			// offline or gone, a running probe finds the entry missing
+			delete(dm.peers, peerIP)
+		}
+	}
+	return targets
+}
+
+// probe checks one node for the NodeInfo endpoint
+func (dm *DiscoveryManager) probe(peerIP string) {
+	relayx := false
+	for _, addr := range peerAddrs(peerIP) {
+		if relayx = dm.probeNodeInfo(addr, peerIP) == nil; relayx {
+			break
+		}
+	}
+
+	dm.mu.Lock()
+	entry, exists := dm.peers[peerIP]
+	if !exists {
+		dm.mu.Unlock()
+		return
+	}
+	wasRelayx := entry.relayx
+	if relayx {
+		entry.backoff = discoveryMinBackoff
+	} else if !entry.checkedAt.IsZero() {
+		entry.backoff = min(entry.backoff*2, discoveryMaxBackoff)
+	}
+	entry.probing = false
+	entry.checkedAt = time.Now()
+	entry.relayx = relayx
+	dm.mu.Unlock()
+
+	if relayx {
+		metricDiscoveryProbes.inc("relayx")
+	} else {
+		metricDiscoveryProbes.inc("other")
+	}
+
+	if relayx && !wasRelayx && presenceScheduler != nil {
+		log.Printf("Discovered relayx node %s", peerIP)
+		presenceScheduler.announceTo(peerIP)
+	}
+}
+
+// probeNodeInfo asks addr for its NodeInfo, which must be peerIP's
+func (dm *DiscoveryManager) probeNodeInfo(addr string, peerIP string) error {
+	ctx, cancel := context.WithTimeout(dm.ctx, discoveryProbeTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("http://%s/", net.JoinHostPort(addr, tcpPort))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dm.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var info NodeInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	if info.TailscaleIP != peerIP {
+		return fmt.Errorf("%s: node info is for %s", url, info.TailscaleIP)
+	}
+	return nil
+}
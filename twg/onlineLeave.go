@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// graceful leave: on shutdown a node says goodbye on every data channel and
+// sends a signed presence packet with leaving set. peers drop it from
+// onlinePeers, close the connection and tell the frontend with peerLeft,
+// instead of waiting for the presence expiry.
+
+var goodbyeFlushDelay = 300 * time.Millisecond // lets the goodbye leave before conns close
+
+// sayGoodbye is called once during graceful shutdown
+func sayGoodbye() {
+	if rtcManager != nil {
+		rtcManager.sendGoodbye()
+	}
+	if presenceScheduler != nil {
+		presenceScheduler.broadcastLeaving()
+	}
+	time.Sleep(goodbyeFlushDelay)
+}
+
+func (rm *RTCManager) sendGoodbye() {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	for peerIP, connection := range rm.connections {
+		connection.mu.RLock()
+		dc := connection.dc
+		connection.mu.RUnlock()
+
+		if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+			if err := dc.SendText(`{"type":"goodbye"}`); err != nil {
+				log.Printf("[RTC dc] Failed to send goodbye to %s: %v", peerIP, err)
+			} else {
+				metricDataChannelMessages.inc("out")
+			}
+		}
+	}
+}
+
+func (ps *PresenceScheduler) broadcastLeaving() {
+	ps.mu.Lock()
+	targets := ps.targets
+	ps.mu.Unlock()
+
+	data := OnlinePeerData{
+		NodeInfo:  nodeInfo,
+		Timestamp: time.Now().UTC().Unix(),
+		Leaving:   true,
+	}
+	packets, err := signPresence(data)
+	if err != nil {
+		log.Printf("Failed to marshal leaving message: %v", err)
+		return
+	}
+	for _, peerIP := range targets {
+		sendUDPMessage(ps.conn, peerIP, string(packets.forPeer(peerIP)))
+	}
+}
+
+// removeLeavingPeer forgets peerIP right away, reason is "presence" or "goodbye"
+func removeLeavingPeer(peerIP string, reason string) {
+	onlinePeersMu.Lock()
+	peerData, online := onlinePeers[peerIP]
+	delete(onlinePeers, peerIP)
+	onlinePeersMu.Unlock()
+
+	closed := false
+	if rtcManager != nil {
+		rtcManager.mu.Lock()
+		if connection, exists := rtcManager.connections[peerIP]; exists {
+			rtcManager.closeConnection(peerIP, connection)
+			closed = true
+		}
+		delete(rtcManager.earlyCandidates, peerIP)
+		rtcManager.mu.Unlock()
+	}
+
+	if !online && !closed {
+		// the other goodbye got here first
+		return
+	}
+	log.Printf("Peer %s left (%s)", peerIP, reason)
+
+	peerLeft := struct {
+		Type     string `json:"type"`
+		Peer     string `json:"peerIP"`
+		Hostname string `json:"hostname,omitempty"`
+		Reason   string `json:"reason"`
+	}{
+		Type:     "peerLeft",
+		Peer:     peerIP,
+		Hostname: peerData.NodeInfo.Hostname,
+		Reason:   reason,
+	}
+	jsonData, _ := json.Marshal(peerLeft)
+	sendMsgWs(jsonData)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// presence scheduling: a node sends a burst of fast packets when it starts and
+// when its state changes, heartbeats at broadcastInterval while in chat, and
+// slows down to presenceIdleInterval once idle. every packet says how long
+// until the next heartbeat, and receivers expire a peer after a few missed
+// heartbeats measured on their own clock, so clock skew doesn't matter.
+
+var (
+	presenceIdleInterval = 10 * time.Second
+	presenceIdleAfter    = 30 * time.Second // without state changes and out of chat
+	presenceBurstGap     = 500 * time.Millisecond
+	presenceBurstCount   = 3
+	presenceMaxRate      = 200.0            // packets per second across all peers
+	presenceTargetsTTL   = 10 * time.Second // how long the tailnet peer list is reused
+	presenceMissedBeats  = 3
+	presenceMinExpiry    = 6 * time.Second
+	presenceLegacyExpiry = 10 * time.Second // peers that don't announce an interval
+)
+
+type PresenceScheduler struct {
+	conn       net.PacketConn
+	lc         *local.Client
+	ctx        context.Context
+	trigger    chan struct{}
+	burstLeft  int
+	lastChange time.Time
+	targets    []string
+	targetsAt  time.Time
+	heartbeat  time.Duration // last announced heartbeat interval
+	discovery  *DiscoveryManager
+	mu         sync.Mutex
+}
+
+var presenceScheduler *PresenceScheduler
+
+func newPresenceScheduler(conn net.PacketConn, lc *local.Client, ctx context.Context, discovery *DiscoveryManager) *PresenceScheduler {
+	return &PresenceScheduler{
+		conn:       conn,
+		lc:         lc,
+		ctx:        ctx,
+		discovery:  discovery,
+		trigger:    make(chan struct{}, 1),
+		burstLeft:  presenceBurstCount,
+		lastChange: time.Now(),
+	}
+}
+
+// triggerPresenceBurst announces a state change to peers right away
+func triggerPresenceBurst() {
+	ps := presenceScheduler
+	if ps == nil {
+		return
+	}
+
+	ps.mu.Lock()
+	ps.burstLeft = presenceBurstCount
+	ps.lastChange = time.Now()
+	ps.mu.Unlock()
+
+	select {
+	case ps.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (ps *PresenceScheduler) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ps.trigger:
+		case <-ps.ctx.Done():
+			return
+		}
+
+		next, heartbeat := ps.nextInterval()
+		ps.broadcast(heartbeat)
+		timer.Reset(next)
+	}
+}
+
+// nextInterval returns the delay before the next packet, and the heartbeat
+// interval announced to peers
+func (ps *PresenceScheduler) nextInterval() (next time.Duration, heartbeat time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	mirrorStateMu.RLock()
+	inChat := mirrorState.IsInChat
+	mirrorStateMu.RUnlock()
+
+	heartbeat = broadcastInterval
+	if !inChat && time.Since(ps.lastChange) > presenceIdleAfter {
+		heartbeat = presenceIdleInterval
+	}
+	heartbeat = max(heartbeat, minInterval(len(ps.targets)))
+
+	next = heartbeat
+	if ps.burstLeft > 0 && heartbeat > presenceBurstGap {
+		ps.burstLeft--
+		next = max(presenceBurstGap, minInterval(len(ps.targets)))
+	}
+	ps.heartbeat = heartbeat
+
+	// up to 10% jitter so nodes started together drift apart
+	next -= time.Duration(rand.Int64N(int64(next/10) + 1))
+	return next, heartbeat
+}
+
+// minInterval keeps the packet rate bounded on large tailnets
+func minInterval(targets int) time.Duration {
+	return time.Duration(float64(targets) / presenceMaxRate * float64(time.Second))
+}
+
+// announceTo sends one packet to a peer that was just seen, instead of a burst to everyone
+func (ps *PresenceScheduler) announceTo(peerIP string) {
+	ps.mu.Lock()
+	heartbeat := ps.heartbeat
+	ps.mu.Unlock()
+
+	if packets, err := presencePacket(heartbeat); err == nil {
+		sendUDPMessage(ps.conn, peerIP, string(packets.forPeer(peerIP)))
+	}
+}
+
+// peerTargets returns the online tailnet peers that run relayx, asking
+// lc.Status at most every presenceTargetsTTL
+func (ps *PresenceScheduler) peerTargets() []string {
+	ps.mu.Lock()
+	if time.Since(ps.targetsAt) < presenceTargetsTTL {
+		targets := ps.targets
+		ps.mu.Unlock()
+		return targets
+	}
+	ps.mu.Unlock()
+
+	status, err := ps.lc.Status(ps.ctx)
+	if err != nil {
+		log.Printf("Failed to get status: %v", err)
+		return nil
+	}
+	if status.BackendState != "Running" {
+		log.Printf("Backend not running, current state: %s", status.BackendState)
+		return nil
+	}
+
+	peers := make([]*ipnstate.PeerStatus, 0, len(status.Peer))
+	for _, peer := range status.Peer {
+		peers = append(peers, peer)
+	}
+	targets := ps.discovery.filter(peers)
+
+	ps.mu.Lock()
+	ps.targets = targets
+	ps.targetsAt = time.Now()
+	ps.mu.Unlock()
+	return targets
+}
+
+// peerExpiry is how long a peer stays online without a packet from it
+func peerExpiry(data OnlinePeerData) time.Duration {
+	if data.IntervalMs <= 0 {
+		return presenceLegacyExpiry
+	}
+	expiry := time.Duration(presenceMissedBeats) * time.Duration(data.IntervalMs) * time.Millisecond
+	if expiry < presenceMinExpiry {
+		expiry = presenceMinExpiry
+	}
+	return expiry
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/tailcfg"
+)
+
+// signed presence: every node signs its presence packets with an ed25519 key
+// kept next to the tsnet state, and puts the public key in NodeInfo. a packet
+// is only accepted when WhoIs knows the UDP source, the claimed IP belongs to
+// the same node, and the signature matches the key pinned for that tailscale
+// node, the first one it signed with. every signed packet carries a sequence
+// number that must be higher than the last one accepted under the key, so a
+// packet can't be replayed. unsigned packets are accepted from builds before
+// PROTOCOL_VERSION 2 until the node has been seen signing, with a strictly
+// increasing timestamp.
+//
+// builds before signing read a packet as plain OnlinePeerData, so peers not
+// yet seen with PROTOCOL_VERSION 2 get an unsigned copy of the data next to
+// the signed one. a pin is only dropped once the node sent nothing acceptable
+// for presencePinTTL, so a node that lost its key (e.g. the key file couldn't
+// be saved) is refused until then. the sequence starts from the clock, so it
+// keeps increasing across restarts with the same key.
+
+const presenceKeyFile = "presence.key"
+
+var presenceRecheck = 60 * time.Second // how long a WhoIs result is trusted
+
+var presenceKey ed25519.PrivateKey
+
+var presenceSeq atomic.Uint64 // last sequence number signed
+
+type SignedPresence struct {
+	*OnlinePeerData                 // unsigned copy for builds before signing, nil otherwise
+	Data            json.RawMessage `json:"data"` // OnlinePeerData
+	Signature       []byte          `json:"sig"`
+}
+
+// initPresenceKey loads the node's presence key from dir, creating it on first run
+func initPresenceKey(dir string) {
+	presenceSeq.Store(uint64(time.Now().UnixNano()))
+	path := filepath.Join(dir, presenceKeyFile)
+
+	seed, err := os.ReadFile(path)
+	if err == nil && len(seed) == ed25519.SeedSize {
+		presenceKey = ed25519.NewKeyFromSeed(seed)
+		return
+	}
+
+	_, presenceKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate presence key: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to create %s, presence key will change on restart: %v", dir, err)
+		return
+	}
+	if err := os.WriteFile(path, presenceKey.Seed(), 0600); err != nil {
+		log.Printf("Failed to save presence key, it will change on restart: %v", err)
+	}
+}
+
+func presencePublicKey() []byte {
+	if presenceKey == nil {
+		return nil
+	}
+	return presenceKey.Public().(ed25519.PublicKey)
+}
+
+// presencePackets is a presence packet signed once, in both envelopes
+type presencePackets struct {
+	signed []byte
+	compat []byte // with the unsigned copy
+}
+
+func signPresence(data OnlinePeerData) (presencePackets, error) {
+	data.Seq = presenceSeq.Add(1)
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return presencePackets{}, err
+	}
+	signed := SignedPresence{
+		Data:      dataBytes,
+		Signature: ed25519.Sign(presenceKey, dataBytes),
+	}
+
+	var packets presencePackets
+	if packets.signed, err = json.Marshal(signed); err != nil {
+		return packets, err
+	}
+	signed.OnlinePeerData = &data
+	packets.compat, err = json.Marshal(signed)
+	return packets, err
+}
+
+// forPeer picks the envelope peerIP understands
+func (p presencePackets) forPeer(peerIP string) []byte {
+	onlinePeersMu.RLock()
+	peerData, online := onlinePeers[peerIP]
+	onlinePeersMu.RUnlock()
+
+	if online && peerData.NodeInfo.ProtocolVersion >= 2 {
+		return p.signed
+	}
+	return p.compat
+}
+
+var (
+	errPresenceMalformed  = errors.New("malformed")
+	errPresenceSpoofed    = errors.New("spoofed")
+	errPresenceUnknown    = errors.New("unknown_peer")
+	errPresenceSignature  = errors.New("bad_signature")
+	errPresenceKeyChanged = errors.New("key_changed")
+	errPresenceUnsigned   = errors.New("unsigned")
+	errPresenceReplayed   = errors.New("replayed")
+)
+
+var presencePinTTL = 10 * time.Minute // a node silent this long may come back with another key
+
+type presencePeer struct {
+	nodeID    tailcfg.StableNodeID
+	addrs     []netip.Addr // tailscale addresses of the node
+	checkedAt time.Time
+}
+
+// presencePin is what a node's packets are checked against
+type presencePin struct {
+	key           ed25519.PublicKey // nil until the node sends a signed packet
+	seq           uint64            // last accepted under key
+	lastTimestamp int64             // last accepted unsigned packet
+	acceptedAt    time.Time
+}
+
+// the PresenceVerifier checks presence packets, the error names the drop reason
+type PresenceVerifier struct {
+	lc    *local.Client
+	ctx   context.Context
+	peers map[netip.Addr]*presencePeer // key is the UDP source
+	pins  map[tailcfg.StableNodeID]*presencePin
+	mu    sync.Mutex
+}
+
+func newPresenceVerifier(lc *local.Client, ctx context.Context) *PresenceVerifier {
+	return &PresenceVerifier{
+		lc:    lc,
+		ctx:   ctx,
+		peers: make(map[netip.Addr]*presencePeer),
+		pins:  make(map[tailcfg.StableNodeID]*presencePin),
+	}
+}
+
+func (pv *PresenceVerifier) verify(packet []byte, addr net.Addr) (OnlinePeerData, error) {
+	var data OnlinePeerData
+
+	var signed SignedPresence
+	if err := json.Unmarshal(packet, &signed); err != nil {
+		return data, errPresenceMalformed
+	}
+	payload := []byte(signed.Data)
+	if len(payload) == 0 {
+		// builds before signing send OnlinePeerData directly
+		payload = packet
+	}
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return data, errPresenceMalformed
+	}
+
+	source, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return data, errPresenceMalformed
+	}
+	claimed, err := netip.ParseAddr(data.NodeInfo.TailscaleIP)
+	if err != nil {
+		return data, errPresenceSpoofed
+	}
+
+	peer, err := pv.lookup(source.Addr().Unmap())
+	if err != nil {
+		return data, err
+	}
+
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+
+	// a dual-stack peer may reach us over the address it isn't keyed by
+	if !slices.Contains(peer.addrs, claimed) {
+		return data, errPresenceSpoofed
+	}
+	for _, addr := range parseAddrs(data.NodeInfo.TailscaleIPs) {
+		if !slices.Contains(peer.addrs, addr) {
+			return data, errPresenceSpoofed
+		}
+	}
+
+	pin := pv.pins[peer.nodeID]
+	if pin == nil || time.Since(pin.acceptedAt) > presencePinTTL {
+		pin = &presencePin{}
+	}
+
+	if len(signed.Data) == 0 {
+		if pin.key != nil || data.NodeInfo.ProtocolVersion >= 2 {
+			return data, errPresenceUnsigned
+		}
+		if data.Timestamp <= pin.lastTimestamp {
+			return data, errPresenceReplayed
+		}
+		pin.lastTimestamp = data.Timestamp
+	} else {
+		key := ed25519.PublicKey(data.NodeInfo.PresenceKey)
+		if len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, signed.Data, signed.Signature) {
+			return data, errPresenceSignature
+		}
+		if pin.key != nil && !bytes.Equal(pin.key, key) {
+			return data, errPresenceKeyChanged
+		}
+		if pin.key != nil && data.Seq <= pin.seq {
+			return data, errPresenceReplayed
+		}
+		pin.key = key
+		pin.seq = data.Seq
+	}
+
+	pin.acceptedAt = time.Now()
+	pv.pins[peer.nodeID] = pin
+	return data, nil
+}
+
+// lookup returns the known sender at addr, asking WhoIs when it is new or due a recheck
+func (pv *PresenceVerifier) lookup(addr netip.Addr) (*presencePeer, error) {
+	pv.mu.Lock()
+	peer, exists := pv.peers[addr]
+	pv.mu.Unlock()
+	if exists && time.Since(peer.checkedAt) < presenceRecheck {
+		return peer, nil
+	}
+
+	who, err := pv.lc.WhoIs(pv.ctx, addr.String())
+	if errors.Is(err, local.ErrPeerNotFound) || (err == nil && who.Node == nil) {
+		return nil, errPresenceUnknown
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: whois %s: %v", errPresenceUnknown, addr, err)
+	}
+
+	pv.mu.Lock()
+	defer pv.mu.Unlock()
+
+	peer, exists = pv.peers[addr]
+	if !exists || peer.nodeID != who.Node.StableID {
+		// the address now belongs to another node, which has its own pin
+		peer = &presencePeer{nodeID: who.Node.StableID}
+		pv.peers[addr] = peer
+	}
+	peer.addrs = peer.addrs[:0]
+	for _, prefix := range who.Node.Addresses {
+		peer.addrs = append(peer.addrs, prefix.Addr())
+	}
+	peer.checkedAt = time.Now()
+	return peer, nil
+}
+
+// dropReason is the metric label for a verify error
+func dropReason(err error) string {
+	for _, reason := range []error{
+		errPresenceMalformed,
+		errPresenceSpoofed,
+		errPresenceUnknown,
+		errPresenceSignature,
+		errPresenceKeyChanged,
+		errPresenceUnsigned,
+		errPresenceReplayed,
+	} {
+		if errors.Is(err, reason) {
+			return reason.Error()
+		}
+	}
+	return "other"
+}
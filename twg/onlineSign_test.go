@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestPresenceVerifierPinsKeys(t *testing.T) {
+	key, seq, info := presenceKey, presenceSeq.Load(), nodeInfo
+	t.Cleanup(func() {
+		presenceKey, nodeInfo = key, info
+		presenceSeq.Store(seq)
+	})
+
+	const peerIP = "100.64.0.2"
+	source := &net.UDPAddr{IP: net.ParseIP(peerIP), Port: 8849}
+	pv := newPresenceVerifier(nil, nil)
+	// known from WhoIs, so verify doesn't ask
+	pv.peers[netip.MustParseAddr(peerIP)] = &presencePeer{
+		nodeID:    "node-2",
+		addrs:     []netip.Addr{netip.MustParseAddr(peerIP)},
+		checkedAt: time.Now().Add(time.Hour),
+	}
+
+	sign := func(newKey bool) []byte {
+		if newKey {
+			_, presenceKey, _ = ed25519.GenerateKey(rand.Reader)
+		}
+		packets, err := signPresence(OnlinePeerData{NodeInfo: NodeInfo{
+			TailscaleIP:     peerIP,
+			ProtocolVersion: PROTOCOL_VERSION,
+			PresenceKey:     presencePublicKey(),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packets.signed
+	}
+	verify := func(packet []byte, want error) {
+		t.Helper()
+		if _, err := pv.verify(packet, source); !errors.Is(err, want) {
+			t.Fatalf("got %v, want %v", err, want)
+		}
+	}
+
+	first := sign(true)
+	second := sign(false)
+	verify(first, nil)
+	verify(first, errPresenceReplayed) // the same sequence number again
+	verify(second, nil)
+	verify(first, errPresenceReplayed) // an older one
+
+	// another key for the same node, even from the right address and node
+	verify(sign(true), errPresenceKeyChanged)
+
+	// the node was silent long enough for the pin to go
+	pv.pins["node-2"].acceptedAt = time.Now().Add(-presencePinTTL - time.Second)
+	verify(sign(false), nil)
+	verify(second, errPresenceKeyChanged)
+}
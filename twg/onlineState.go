@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"unicode/utf8"
+)
+
+// presence carries a compact summary of the local PeerState, so peers know
+// who is in which chat before any peer connection exists. the full state
+// still goes through the data channel once connected.
+
+// bump when a field changes meaning, receivers ignore summaries of other versions
+const STATE_SUMMARY_VERSION = 1
+
+const maxSummaryNameLen = 64 // bytes, keeps presence packets small
+
+const (
+	STATE_INPUT_MUTED    uint8 = 1 << 0
+	STATE_OUTPUT_MUTED   uint8 = 1 << 1
+	STATE_SHARING_SCREEN uint8 = 1 << 2
+	STATE_SHARING_AUDIO  uint8 = 1 << 3
+	STATE_SHARING_CAMERA uint8 = 1 << 4
+)
+
+type StateSummary struct {
+	Version    int    `json:"v"`
+	Name       string `json:"n,omitempty"`
+	AvatarHash string `json:"a,omitempty"` // first 8 bytes of the avatar's sha256, hex
+	InChat     bool   `json:"c,omitempty"`
+	Room       string `json:"r,omitempty"`
+	Flags      uint8  `json:"f,omitempty"`
+}
+
+func summarizeState(state PeerState) *StateSummary {
+	summary := &StateSummary{
+		Version: STATE_SUMMARY_VERSION,
+		Name:    truncateUTF8(state.UserName, maxSummaryNameLen),
+		InChat:  state.IsInChat,
+		Room:    truncateUTF8(state.Room, maxSummaryNameLen),
+	}
+	if state.UserAvatar != "" {
+		sum := sha256.Sum256([]byte(state.UserAvatar))
+		summary.AvatarHash = hex.EncodeToString(sum[:8])
+	}
+	if state.IsInputMuted {
+		summary.Flags |= STATE_INPUT_MUTED
+	}
+	if state.IsOutputMuted {
+		summary.Flags |= STATE_OUTPUT_MUTED
+	}
+	if state.IsSharingScreen {
+		summary.Flags |= STATE_SHARING_SCREEN
+	}
+	if state.IsSharingAudio {
+		summary.Flags |= STATE_SHARING_AUDIO
+	}
+	if state.IsSharingCamera {
+		summary.Flags |= STATE_SHARING_CAMERA
+	}
+	return summary
+}
+
+// localStateSummary summarizes mirrorState for the next presence packet
+func localStateSummary() *StateSummary {
+	mirrorStateMu.RLock()
+	defer mirrorStateMu.RUnlock()
+	return summarizeState(mirrorState)
+}
+
+func truncateUTF8(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	s = s[:maxLen]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// peerSummary returns the state summary peerIP announced, nil when unknown
+func peerSummary(peerIP string) *StateSummary {
+	onlinePeersMu.RLock()
+	defer onlinePeersMu.RUnlock()
+
+	peerData, exists := onlinePeers[peerIP]
+	if !exists || peerData.State == nil || peerData.State.Version != STATE_SUMMARY_VERSION {
+		return nil
+	}
+	return peerData.State
+}
+
+// peerNeedsConnection tells whether a connection to peerIP is worth setting up
+// with lazy mesh on: only when one side is in chat, or the peer's state is unknown
+func peerNeedsConnection(peerIP string) bool {
+	if !lazyMesh {
+		return true
+	}
+	summary := peerSummary(peerIP)
+	if summary == nil || summary.InChat {
+		return true
+	}
+
+	mirrorStateMu.RLock()
+	defer mirrorStateMu.RUnlock()
+	return mirrorState.IsInChat
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+)
+
+// protocol version and feature advertisement. every node puts its version,
+// codecs, track kinds and feature flags into NodeInfo (presence and the /
+// endpoint) and into its signaling payloads. a connection only uses the
+// features both sides list.
+
+// bump when a change can't be negotiated through feature flags
+const PROTOCOL_VERSION = 2
+
+const (
+	FEATURE_TRICKLE_ICE          = "trickle-ice"
+	FEATURE_RENEGOTIATION        = "renegotiation"
+	FEATURE_ICE_RESTART          = "ice-restart"
+	FEATURE_SESSIONS             = "sessions"
+	FEATURE_STRUCTURED_SIGNALING = "structured-signaling"
+)
+
+func localFeatures() []string {
+	features := []string{
+		FEATURE_RENEGOTIATION,
+		FEATURE_ICE_RESTART,
+		FEATURE_SESSIONS,
+		FEATURE_STRUCTURED_SIGNALING,
+	}
+	if trickleICE {
+		features = append(features, FEATURE_TRICKLE_ICE)
+	}
+	return features
+}
+
+// localCodecs lists the mime types of every track in trackMap and the screen share codecs
+func localCodecs() []string {
+	seen := make(map[string]bool)
+	var codecs []string
+	for _, t := range trackMap {
+		if !seen[t.MimeType] {
+			seen[t.MimeType] = true
+			codecs = append(codecs, t.MimeType)
+		}
+	}
+	for _, mimeType := range screenCodecs {
+		if !seen[mimeType] {
+			seen[mimeType] = true
+			codecs = append(codecs, mimeType)
+		}
+	}
+	sort.Strings(codecs)
+	return codecs
+}
+
+func localTrackKinds() []string {
+	var kinds []string
+	for _, t := range trackMap {
+		kinds = append(kinds, t.id)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// negotiateFeatures returns the features both sides support
+func negotiateFeatures(peerFeatures []string) map[string]bool {
+	negotiated := make(map[string]bool)
+	for _, local := range localFeatures() {
+		for _, remote := range peerFeatures {
+			if local == remote {
+				negotiated[local] = true
+			}
+		}
+	}
+	return negotiated
+}
+
+// peerFeatures reads the advertised features of peerIP from presence
+func peerFeatures(peerIP string) []string {
+	onlinePeersMu.RLock()
+	defer onlinePeersMu.RUnlock()
+
+	peerData, exists := onlinePeers[peerIP]
+	if !exists {
+		return nil
+	}
+	features := peerData.NodeInfo.Features
+	if peerData.NodeInfo.TrickleICE && len(features) == 0 {
+		features = []string{FEATURE_TRICKLE_ICE}
+	}
+	return features
+}
+
+func (c *RTCConnection) hasFeature(feature string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.features[feature]
+}
+
+// featureList returns the negotiated features sorted, caller must hold c.mu
+func (c *RTCConnection) featureList() []string {
+	features := make([]string, 0, len(c.features))
+	for feature := range c.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	return features
+}
+
+var (
+	versionWarned   = make(map[string]int) // key is peerIP, value is the version warned about
+	versionWarnedMu sync.Mutex
+)
+
+// checkPeerVersion warns the frontend once when peerIP runs another protocol version
+func checkPeerVersion(peerIP string, info NodeInfo) {
+	if info.ProtocolVersion == PROTOCOL_VERSION {
+		return
+	}
+
+	versionWarnedMu.Lock()
+	warned, exists := versionWarned[peerIP]
+	versionWarned[peerIP] = info.ProtocolVersion
+	versionWarnedMu.Unlock()
+	if exists && warned == info.ProtocolVersion {
+		return
+	}
+
+	log.Printf("Peer %s (%s) runs protocol version %d, local version is %d", peerIP, info.Hostname, info.ProtocolVersion, PROTOCOL_VERSION)
+
+	warning := struct {
+		Type         string `json:"type"`
+		Peer         string `json:"peerIP"`
+		Hostname     string `json:"hostname"`
+		LocalVersion int    `json:"localVersion"`
+		PeerVersion  int    `json:"peerVersion"`
+	}{
+		Type:         "versionMismatch",
+		Peer:         peerIP,
+		Hostname:     info.Hostname,
+		LocalVersion: PROTOCOL_VERSION,
+		PeerVersion:  info.ProtocolVersion,
+	}
+	jsonData, _ := json.Marshal(warning)
+	sendMsgWs(jsonData)
+}
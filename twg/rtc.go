@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"log"
@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pion/ice/v4"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/interceptor/pkg/gcc"
@@ -20,6 +21,9 @@ import (
 
 type RTCRole string
 
+// an offer without answer for this long is dropped and offered again
+var answerTimeout = 15 * time.Second
+
 const (
 	OFFER  RTCRole = "offer"
 	ANSWER RTCRole = "answer"
@@ -29,16 +33,32 @@ type RTCConnection struct {
 	pc                *webrtc.PeerConnection
 	peerIP            string
 	role              RTCRole
+	identity          *PeerIdentity // tailscale node and user behind peerIP, from WhoIs
+	sessionID         string        // picked by the offer side, one per connection lifetime
+	generation        uint64        // bumped by every offer/answer exchange within the session
 	dc                *webrtc.DataChannel
 	pdc               *webrtc.DataChannel
 	candidatesMu      sync.RWMutex
-	pendingCandidates []*webrtc.ICECandidate
+	pendingCandidates []*webrtc.ICECandidate // local candidates not yet sent to peer
+	trickle           bool                   // both sides agreed to trickle ICE
+	features          map[string]bool        // features supported by both sides
+	localDescSent     bool                   // local sdp has been delivered, candidates can go out directly
+	remoteDescSet     bool                   // remote sdp is applied, remote candidates can be added directly
+	remoteCandidates  []webrtc.ICECandidateInit
+	negotiationMu     sync.Mutex                               // one renegotiation at a time
+	supervising       bool                                     // a recovery supervisor is running
 	tracks            map[uint8]*webrtc.TrackLocalStaticSample // key is track.ID
 	targetBitrate     int
 	targetBitrates    map[uint8]uint32 // key is track.ID
 	isInChat          bool
+	room              string                      // empty for peers without rooms
+	admittedRoom      string                      // private room the peer proved membership of
 	senders           map[uint8]*webrtc.RTPSender // key is track.ID
-	videoRTCtrack     *webrtc.TrackLocalStaticRTP
+	videoLayers       map[uint8]int               // simulcast layer forwarded per video track
+	svcSeq            uint16                      // last sequence number written to videoRTCtrack
+	simulcastMu       sync.Mutex
+	videoRTCtrack     *webrtc.TrackLocalStaticRTP // screen share, packetized by the gateway
+	screenCodec       string                      // mime type the screen share is sent in
 	CreatedAt         time.Time
 	mu                sync.RWMutex
 	lastPingTime      time.Time
@@ -57,55 +77,76 @@ type RTCManager struct {
 	mu                sync.RWMutex
 	pendingEstimators []cc.BandwidthEstimator // 待分配的估计器队列
 	estimatorQueue    sync.Mutex
+	earlyCandidates   map[string][]ICECandidatePayload // trickled candidates arrived before the offer, key is peer IP
+	roster            roomRoster
+	moderation        moderationState
 }
 
 type SDPWithICE struct {
 	SDP     webrtc.SessionDescription `json:"sdp"`
 	ICEList []*webrtc.ICECandidate    `json:"iceList"`
+	Trickle bool                      `json:"trickle,omitempty"` // candidates follow via /ice_candidate
 }
 
 type HTTPpayload struct {
 	From       string     `json:"from"`
 	Role       RTCRole    `json:"role"`
+	SessionID  string     `json:"sessionId,omitempty"`  // empty from builds without session support
+	Generation uint64     `json:"generation,omitempty"` // 1 for the initial offer
 	SDPWithICE SDPWithICE `json:"sdpWithICE"`
+
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	ScreenCodecs    []string `json:"screenCodecs,omitempty"` // preference order, VP9 when empty
+
+	Identity *PeerIdentity `json:"-"` // filled from WhoIs by the receiving handler, never sent
 }
 
-func (rm *RTCManager) sendViaTS(
-	role RTCRole,
-	targetIP string,
-	sdp webrtc.SessionDescription,
-	iceList []*webrtc.ICECandidate,
-) {
-	payload := HTTPpayload{
-		From: nodeInfo.TailscaleIP,
-		Role: role,
-		SDPWithICE: SDPWithICE{
-			SDP:     sdp,
-			ICEList: iceList,
-		},
-	}
+// sendViaTS delivers the local sdp to the peer and reports whether it was
+// accepted. a connection the peer refused is dropped so it can be retried,
+// except after losing a glare where the peer's own offer is on its way.
+func (rm *RTCManager) sendViaTS(connection *RTCConnection, sdpWithIce SDPWithICE) bool {
+	role := connection.role
+	targetIP := connection.peerIP
 
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("[RTC] Failed to marshal JSON: %v", err)
-		return
+	connection.mu.RLock()
+	payload := HTTPpayload{
+		From:            nodeInfo.TailscaleIP,
+		Role:            role,
+		SessionID:       connection.sessionID,
+		Generation:      connection.generation,
+		SDPWithICE:      sdpWithIce,
+		ProtocolVersion: PROTOCOL_VERSION,
+		Features:        localFeatures(),
+		ScreenCodecs:    screenCodecs,
 	}
+	connection.mu.RUnlock()
 
 	endpoint := "offer_ice"
 	if role == ANSWER {
 		endpoint = "answer_ice"
 	}
-	url := fmt.Sprintf("http://%s:%s/%s", targetIP, tcpPort, endpoint)
-	// log.Printf("[RTC] URL: %s, Payload: %s", url, string(jsonData))
 
-	resp, err := rm.client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("[RTC] Failed to send HTTP request to %s: %v", targetIP, err)
-		return
+	if _, err := rm.postSignaling(targetIP, endpoint, payload); err != nil {
+		if errors.Is(err, errGlareRejected) {
+			log.Printf("[RTC] Offer to %s lost the glare, waiting for its offer", targetIP)
+			return false
+		}
+		log.Printf("[RTC] Failed to deliver %s to %s: %v", endpoint, targetIP, err)
+		rm.dropConnection(connection)
+		return false
 	}
-	defer resp.Body.Close()
+	return true
+}
+
+// dropConnection closes connection if it is still the current one for its peer
+func (rm *RTCManager) dropConnection(connection *RTCConnection) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
 
-	// log.Printf("[RTC] HTTP response status: %s", resp.Status)
+	if rm.connections[connection.peerIP] == connection {
+		rm.closeConnection(connection.peerIP, connection)
+	}
 }
 
 func (rm *RTCManager) assignEstimatorToPeer(peerIP string) {
@@ -162,8 +203,13 @@ func initWebRTC(conn net.PacketConn, httpClient *http.Client) {
 
 	// setup settingengine
 	settingEngine := webrtc.SettingEngine{}
-	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4}) // only collect udp4 ice
-	settingEngine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))                  // only use tailscale's conn
+	settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	// only use tailscale's conns, one per address family
+	var muxes []ice.UDPMux
+	for _, c := range splitConn(conn) {
+		muxes = append(muxes, webrtc.NewICEUDPMux(nil, c))
+	}
+	settingEngine.SetICEUDPMux(ice.NewMultiUDPMuxDefault(muxes...))
 
 	api := webrtc.NewAPI(
 		webrtc.WithSettingEngine(settingEngine),
@@ -175,6 +221,9 @@ func initWebRTC(conn net.PacketConn, httpClient *http.Client) {
 		connections:       make(map[string]*RTCConnection),
 		estimators:        make(map[string]cc.BandwidthEstimator),
 		pendingEstimators: make([]cc.BandwidthEstimator, 0),
+		earlyCandidates:   make(map[string][]ICECandidatePayload),
+		roster:            newRoomRoster(),
+		moderation:        newModerationState(),
 		api:               api,
 		client:            httpClient,
 	}
@@ -217,33 +266,98 @@ func (rm *RTCManager) createRTCtoOnlinePeers() {
 			continue
 		}
 
+		if !peerAccess(peerIP).canConnect() || !peerNeedsConnection(peerIP) {
+			continue
+		}
+
 		if _, exists := rm.connections[peerIP]; !exists {
 			// 使用较晚启动或随机ID较大的节点发起连接，避免双向连接
 			shouldCreateConnection := nodeInfo.StartTime > peerData.NodeInfo.StartTime ||
 				(nodeInfo.StartTime == peerData.NodeInfo.StartTime && nodeInfo.RandomID > peerData.NodeInfo.RandomID)
 
 			if shouldCreateConnection {
-				go rm.createConnection(OFFER, peerIP, nil)
+				go func(peerIP string) {
+					if err := rm.createConnection(OFFER, peerIP, nil); err != nil {
+						log.Printf("%v", err)
+					}
+				}(peerIP)
 			}
 			// createConnection will be called when receiving sdp on answer side
 		}
 	}
 
-	// remove offline peer's connection
+	// remove offline peer's connection, and peers whose access was revoked
 	for peerIP, connection := range rm.connections {
 		if _, exists := currentPeers[peerIP]; !exists {
 			rm.closeConnection(peerIP, connection)
+		} else if connection.role == OFFER && !connection.hasRemoteDescription() &&
+			time.Since(connection.CreatedAt) > answerTimeout {
+			log.Printf("[RTC] No answer from %s within %v, retrying", peerIP, answerTimeout)
+			rm.closeConnection(peerIP, connection)
+		} else if access, known := peerAccessManager.cached(peerIP); known && !access.canConnect() {
+			log.Printf("[RTC] Closing connection to %s, access revoked", peerIP)
+			rm.closeConnection(peerIP, connection)
+		}
+	}
+	for peerIP := range rm.earlyCandidates {
+		if _, exists := currentPeers[peerIP]; !exists {
+			delete(rm.earlyCandidates, peerIP)
 		}
 	}
 }
 
-func (rm *RTCManager) createConnection(role RTCRole, peerIP string, sdpWithIce *SDPWithICE) {
+// createConnection starts a new session as offer side when offer is nil,
+// or answers the given offer. it returns once the connection is set up,
+// the local sdp is delivered to the peer in the background.
+func (rm *RTCManager) createConnection(role RTCRole, peerIP string, offer *HTTPpayload) error {
+	// start from the announced state so media flows before the first userState
+	isInChat := false
+	room := ""
+	if summary := peerSummary(peerIP); summary != nil {
+		isInChat = summary.InChat
+		room = summary.Room
+	}
+	return rm.createConnectionWithState(role, peerIP, offer, isInChat, room)
+}
+
+// createConnectionWithState is createConnection with the chat state carried
+// over from a connection that is being rebuilt
+func (rm *RTCManager) createConnectionWithState(role RTCRole, peerIP string, offer *HTTPpayload, isInChat bool, room string) error {
 	log.Printf("[RTC] Creating %s connection to peer %s", role, peerIP)
 
+	var sdpWithIce *SDPWithICE
+	var identity *PeerIdentity
+	sessionID := newSessionID()
+	generation := uint64(1)
+	// the offer side only knows what the peer announced, the answer is checked again
+	features := negotiateFeatures(peerFeatures(peerIP))
+	screenCodec := negotiateScreenCodec(peerCodecs(peerIP))
+	if offer != nil {
+		sdpWithIce = &offer.SDPWithICE
+		identity = offer.Identity
+		sessionID = offer.SessionID
+		generation = offer.Generation
+		features = negotiateFeatures(offer.Features)
+		screenCodec = negotiateScreenCodec(offer.ScreenCodecs)
+	}
+
+	rm.mu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			rm.mu.Unlock()
+		}
+	}()
+
+	if role == ANSWER && offer != nil {
+		if err := rm.admitOfferLocked(offer); err != nil {
+			return err
+		}
+	}
+
 	pc, err := rm.api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
-		log.Printf("[RTC] Failed to create peer connection for %s: %v", peerIP, err)
-		return
+		return fmt.Errorf("[RTC] Failed to create peer connection for %s: %v", peerIP, err)
 	}
 
 	rm.assignEstimatorToPeer(peerIP)
@@ -253,44 +367,68 @@ func (rm *RTCManager) createConnection(role RTCRole, peerIP string, sdpWithIce *
 	if role == OFFER {
 		dc, err = pc.CreateDataChannel("data", nil)
 		if err != nil {
-			log.Printf("[RTC] Failed to create data channel for %s: %v", peerIP, err)
 			pc.Close()
-			return
+			return fmt.Errorf("[RTC] Failed to create data channel for %s: %v", peerIP, err)
 		}
 		rm.setupDataChannelHandlers(dc, peerIP)
 
 		pdc, err = pc.CreateDataChannel("ping", nil)
 		if err != nil {
-			log.Printf("[RTC] Failed to create ping data channel for %s: %v", peerIP, err)
 			pc.Close()
-			return
+			return fmt.Errorf("[RTC] Failed to create ping data channel for %s: %v", peerIP, err)
 		}
 		rm.setupPingDataChannel(pdc, peerIP)
 	}
 
+	// trickle only when the other side has said it understands /ice_candidate
+	trickle := false
+	switch role {
+	case OFFER:
+		trickle = features[FEATURE_TRICKLE_ICE]
+	case ANSWER:
+		trickle = trickleICE && sdpWithIce != nil && sdpWithIce.Trickle
+	}
+
 	connection := &RTCConnection{
 		pc:                pc,
 		peerIP:            peerIP,
 		role:              role,
+		identity:          identity,
+		sessionID:         sessionID,
+		generation:        generation,
 		dc:                dc, // nil at answer side
 		pdc:               pdc,
 		pendingCandidates: make([]*webrtc.ICECandidate, 0),
+		trickle:           trickle,
+		features:          features,
 		tracks:            make(map[uint8]*webrtc.TrackLocalStaticSample),
 		targetBitrates: map[uint8]uint32{
 			MICROPHONE_AUDIO:   audioBitrateList[0],
 			CPA_AUDIO:          audioBitrateList[0],
 			SCREEN_SHARE_VIDEO: videoBitrateList[0],
+			CAMERA_VIDEO:       cameraBitrateList[0],
 		},
-		isInChat:  false,
-		senders:   make(map[uint8]*webrtc.RTPSender),
-		CreatedAt: time.Now(),
+		isInChat:    isInChat,
+		room:        room,
+		senders:     make(map[uint8]*webrtc.RTPSender),
+		videoLayers: make(map[uint8]int),
+		screenCodec: screenCodec,
+		CreatedAt:   time.Now(),
 	}
 
 	// 设置事件处理器
 	// rm.setupConnectionHandlers(connection)
 
-	rm.mu.Lock()
-	defer rm.mu.Unlock()
+	// a new offer replaces a connection the peer has given up on, keep its chat state
+	if existing, exists := rm.connections[peerIP]; exists {
+		existing.mu.RLock()
+		if existing.isInChat {
+			connection.isInChat = true
+			connection.room = existing.room
+		}
+		existing.mu.RUnlock()
+		rm.closeConnection(peerIP, existing)
+	}
 
 	rm.addTracks(pc, connection)
 
@@ -301,66 +439,110 @@ func (rm *RTCManager) createConnection(role RTCRole, peerIP string, sdpWithIce *
 	case OFFER:
 		sdp, err = pc.CreateOffer(nil)
 		if err != nil {
-			log.Printf("[RTC] Failed to create offer for %s: %v", peerIP, err)
 			rm.closeConnection(peerIP, connection)
-			return
+			return fmt.Errorf("[RTC] Failed to create offer for %s: %v", peerIP, err)
 		}
 
 	case ANSWER:
 		if sdpWithIce == nil {
-			log.Printf("[RTC] Error: remoteOffer is nil for answer role")
 			rm.closeConnection(peerIP, connection)
-			return
+			return fmt.Errorf("[RTC] Error: remoteOffer is nil for answer role")
 		}
 
 		if err := pc.SetRemoteDescription(sdpWithIce.SDP); err != nil {
-			log.Printf("[RTC] Error setting remote description for %s: %v", peerIP, err)
 			rm.closeConnection(peerIP, connection)
-			return
+			return fmt.Errorf("[RTC] Error setting remote description for %s: %v", peerIP, err)
 		}
 
 		sdp, err = pc.CreateAnswer(nil)
 		if err != nil {
-			log.Printf("[RTC] Failed to create answer for %s: %v", peerIP, err)
 			rm.closeConnection(peerIP, connection)
-			return
+			return fmt.Errorf("[RTC] Failed to create answer for %s: %v", peerIP, err)
 		}
 
 		if err := addICE(connection.pc, sdpWithIce.ICEList); err != nil {
-			log.Printf("[RTC] Error adding ICE candidates for %s: %v", peerIP, err)
 			rm.closeConnection(peerIP, connection)
-			return
+			return fmt.Errorf("[RTC] Error adding ICE candidates for %s: %v", peerIP, err)
+		}
+
+		// candidates trickled in before this offer was processed
+		early := rm.takeEarlyCandidates(peerIP, sessionID)
+		if err := connection.markRemoteDescriptionSet(early); err != nil {
+			log.Printf("[RTC] Error adding trickled ICE candidates for %s: %v", peerIP, err)
 		}
 	}
 
 	// Store the connection
 	rm.connections[peerIP] = connection
+	rm.updateRoster(peerIP, connection.isInChat, connection.room)
+
+	// don't hold the manager while talking to the peer, it may be offering to us at the same time
+	rm.mu.Unlock()
+	locked = false
+
+	go rm.deliverLocalDescription(connection, sdp)
+	return nil
+}
+
+// deliverLocalDescription applies sdp locally and sends it to the peer, a
+// connection whose sdp can't be delivered is dropped so it is retried later
+func (rm *RTCManager) deliverLocalDescription(connection *RTCConnection, sdp webrtc.SessionDescription) {
+	pc := connection.pc
+	peerIP := connection.peerIP
+
+	if connection.trickle {
+		if err := pc.SetLocalDescription(sdp); err != nil {
+			log.Printf("[RTC] Failed to set local description for %s: %v", peerIP, err)
+			rm.dropConnection(connection)
+			return
+		}
+		if rm.sendViaTS(connection, SDPWithICE{SDP: sdp, Trickle: true}) {
+			rm.flushLocalCandidates(connection)
+		}
+		return
+	}
 
 	// ⭐
 	gatherComplete := webrtc.GatheringCompletePromise(pc)
-	if err = pc.SetLocalDescription(sdp); err != nil {
-		log.Panicf("[RTC] Failed to set local description for %s: %v", peerIP, err)
+	if err := pc.SetLocalDescription(sdp); err != nil {
+		log.Printf("[RTC] Failed to set local description for %s: %v", peerIP, err)
+		rm.dropConnection(connection)
+		return
 	}
 	<-gatherComplete
 	// fmt.Println("ICE Gathering is officially complete (via GatheringCompletePromise).")
 
-	rm.sendViaTS(role, peerIP, sdp, connection.pendingCandidates)
+	connection.candidatesMu.RLock()
+	iceList := append([]*webrtc.ICECandidate(nil), connection.pendingCandidates...)
+	connection.candidatesMu.RUnlock()
+
+	rm.sendViaTS(connection, SDPWithICE{SDP: sdp, ICEList: iceList})
 }
 
-func (rm *RTCManager) HandleAnswer(peerIP string, sdpWithIce *SDPWithICE) error {
+func (rm *RTCManager) HandleAnswer(peerIP string, answer *HTTPpayload) error {
+	sdpWithIce := &answer.SDPWithICE
+
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
 	connection, exists := rm.connections[peerIP]
 	if !exists {
-		return fmt.Errorf("[RTC] receiving answer from %s but connection not found", peerIP)
+		return fmt.Errorf("[RTC] receiving answer from %s but connection not found: %w", peerIP, errStaleNegotiation)
 	}
 
 	connection.mu.Lock()
 	defer connection.mu.Unlock()
 
 	if connection.role != OFFER {
-		return fmt.Errorf("[RTC] receiving answer from %s but self role is not offer", peerIP)
+		return fmt.Errorf("[RTC] receiving answer from %s but self role is not offer: %w", peerIP, errStaleNegotiation)
+	}
+
+	if err := connection.checkAnswer(answer); err != nil {
+		return err
+	}
+	connection.identity = answer.Identity
+	if answer.ProtocolVersion > 0 {
+		connection.features = negotiateFeatures(answer.Features)
 	}
 
 	if err := connection.pc.SetRemoteDescription(sdpWithIce.SDP); err != nil {
@@ -373,6 +555,10 @@ func (rm *RTCManager) HandleAnswer(peerIP string, sdpWithIce *SDPWithICE) error
 		return fmt.Errorf("[RTC] Error adding ICE candidates for %s: %v", peerIP, err)
 	}
 
+	if err := connection.markRemoteDescriptionSet(nil); err != nil {
+		return fmt.Errorf("[RTC] Error adding trickled ICE candidates for %s: %v", peerIP, err)
+	}
+
 	return nil
 }
 
@@ -396,6 +582,7 @@ func (rm *RTCManager) closeConnection(peerIP string, connection *RTCConnection)
 		log.Printf("[RTC] Error closing connection to %s: %v", peerIP, err)
 	}
 	delete(rm.connections, peerIP)
+	rm.removeFromRoster(peerIP)
 }
 
 func (rm *RTCManager) setupPcHandlers(pc *webrtc.PeerConnection, connection *RTCConnection) {
@@ -403,7 +590,11 @@ func (rm *RTCManager) setupPcHandlers(pc *webrtc.PeerConnection, connection *RTC
 		log.Printf("[RTC onTrack] received track: streamID:%s, ID:%s", track.StreamID(), track.ID())
 
 		go handleRTCP("receiver:"+track.ID(), receiver)
-		handleTrack(track, connection.peerIP)
+		if !peerAccess(connection.peerIP).canSend() {
+			log.Printf("[RTC onTrack] ignoring track %s from listen-only peer %s", track.ID(), connection.peerIP)
+			return
+		}
+		handleTrack(track, connection.peerIP, pc)
 	})
 
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
@@ -415,6 +606,10 @@ func (rm *RTCManager) setupPcHandlers(pc *webrtc.PeerConnection, connection *RTC
 
 		connection.candidatesMu.Lock()
 		defer connection.candidatesMu.Unlock()
+		if connection.trickle && connection.localDescSent {
+			go rm.sendCandidateViaTS(connection.peerIP, connection.sessionID, candidate)
+			return
+		}
 		connection.pendingCandidates = append(connection.pendingCandidates, candidate)
 	})
 
@@ -431,6 +626,8 @@ func (rm *RTCManager) setupPcHandlers(pc *webrtc.PeerConnection, connection *RTC
 		jsonData, _ := json.Marshal(stateData)
 		sendMsgWs(jsonData)
 
+		rm.onConnectionState(connection, state)
+
 		// if state == webrtc.PeerConnectionStateConnected {
 		// 	for _, transceiver := range pc.GetTransceivers() {
 		// 		log.Printf("[RTC on %s] Transceiver mid=%s, direction=%s, kind=%v",
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/pion/rtp/codecs/vp9"
+	"github.com/pion/webrtc/v4"
+)
+
+// screen share codecs: each node lists the codecs it shares with in order of
+// preference (--screen-codecs), and advertises them in NodeInfo.Codecs and
+// the offer. the screen share sent to a peer uses the first preferred codec
+// the peer has too, VP9 for peers that advertise none. the frontend is told
+// which codecs are in use through rtc_status and encodes each of them, chunks
+// and frames carry the codec ID.
+
+const (
+	CODEC_VP9  uint8 = 0
+	CODEC_H264 uint8 = 1
+	CODEC_AV1  uint8 = 2
+	CODEC_VP8  uint8 = 3
+)
+
+var codecMimeTypes = map[uint8]string{
+	CODEC_VP9:  webrtc.MimeTypeVP9,
+	CODEC_H264: webrtc.MimeTypeH264,
+	CODEC_AV1:  webrtc.MimeTypeAV1,
+	CODEC_VP8:  webrtc.MimeTypeVP8,
+}
+
+var screenCodecNames = map[string]string{
+	"vp9":  webrtc.MimeTypeVP9,
+	"h264": webrtc.MimeTypeH264,
+	"av1":  webrtc.MimeTypeAV1,
+}
+
+// screenCodecs is the local preference order, as mime types
+var screenCodecs = []string{webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeAV1}
+
+// setScreenCodecs sets the preference order from codec names, e.g. h264,vp9
+func setScreenCodecs(names []string) {
+	var mimeTypes []string
+	for _, name := range names {
+		mimeType, known := screenCodecNames[strings.ToLower(name)]
+		if !known {
+			log.Printf("Ignoring unknown screen codec %q", name)
+			continue
+		}
+		if !slices.Contains(mimeTypes, mimeType) {
+			mimeTypes = append(mimeTypes, mimeType)
+		}
+	}
+	if len(mimeTypes) > 0 {
+		screenCodecs = mimeTypes
+	}
+}
+
+func codecID(mimeType string) (uint8, bool) {
+	for id, m := range codecMimeTypes {
+		if strings.EqualFold(m, mimeType) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func hasCodec(codecList []string, mimeType string) bool {
+	return slices.ContainsFunc(codecList, func(c string) bool {
+		return strings.EqualFold(c, mimeType)
+	})
+}
+
+// isScreenCodec reports whether mimeType is one screen share can be sent in
+func isScreenCodec(mimeType string) bool {
+	for _, m := range screenCodecNames {
+		if strings.EqualFold(m, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateScreenCodec picks the codec to send screen share in to a peer with peerCodecs
+func negotiateScreenCodec(peerCodecs []string) string {
+	for _, mimeType := range screenCodecs {
+		if hasCodec(peerCodecs, mimeType) {
+			return mimeType
+		}
+	}
+	// builds before codec negotiation only have VP9
+	return webrtc.MimeTypeVP9
+}
+
+// peerCodecs returns the codecs the peer announced in its presence
+func peerCodecs(peerIP string) []string {
+	onlinePeersMu.RLock()
+	defer onlinePeersMu.RUnlock()
+
+	if peerData, exists := onlinePeers[peerIP]; exists {
+		return peerData.NodeInfo.Codecs
+	}
+	return nil
+}
+
+// screenCodecsInUseLocked lists the codec IDs the frontend has to encode screen
+// share in, caller must hold rm.mu
+func (rm *RTCManager) screenCodecsInUseLocked() []int {
+	inUse := []int{}
+	for _, connection := range rm.connections {
+		connection.mu.RLock()
+		id, known := codecID(connection.screenCodec)
+		connection.mu.RUnlock()
+		if known && !slices.Contains(inUse, int(id)) {
+			inUse = append(inUse, int(id))
+		}
+	}
+	slices.Sort(inUse)
+	return inUse
+}
+
+// isKeyframe inspects a depacketized frame
+func isKeyframe(mimeType string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		var header vp9.Header
+		return header.Unmarshal(frame) == nil && !header.NonKeyFrame
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return frame[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		// annex b, look for an IDR slice
+		for _, nalu := range bytes.Split(frame, []byte{0, 0, 1}) {
+			if len(nalu) > 0 && nalu[0]&0x1F == 5 {
+				return true
+			}
+		}
+		return false
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		// encoders put a sequence header OBU in every keyframe's temporal unit
+		return av1OBU(frame, av1OBUSeqHeader) != nil
+	}
+	return false
+}
+
+func leb128(b []byte) (value uint64, n int) {
+	for i := 0; i < len(b) && i < 8; i++ {
+		value |= uint64(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+		frame    []byte
+		want     bool
+	}{
+		// frame marker 2, profile 0, show_existing_frame 0, frame_type 0, then the sync code
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x13, 0xF0, 0x0E, 0xF6, 0x00}, true},
+		{"vp9 inter frame", webrtc.MimeTypeVP9, []byte{0x86, 0x00, 0x40, 0x92, 0x88, 0x2C}, false},
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A}, true},
+		{"vp8 inter frame", webrtc.MimeTypeVP8, []byte{0x31, 0x01, 0x00}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x68, 0xCE, 0, 0, 1, 0x65, 0x88}, true},
+		{"h264 non-idr", webrtc.MimeTypeH264, []byte{0, 0, 0, 1, 0x41, 0x9A}, false},
+		{"av1 with sequence header", webrtc.MimeTypeAV1, av1SequenceHeader(640, 480), true},
+		{"av1 without sequence header", webrtc.MimeTypeAV1, []byte{0x12, 0x00, 0x32, 0x01, 0x00}, false},
+		{"empty", webrtc.MimeTypeVP8, nil, false},
+		{"unknown codec", "video/unknown", []byte{0x00}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isKeyframe(tt.mimeType, tt.frame); got != tt.want {
+				t.Fatalf("isKeyframe = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,6 +8,22 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
+// listenOnlyMessages are the data channel messages a listen-only peer may
+// send, they only move the peer itself in and out of rooms so it can receive
+var listenOnlyMessages = map[string]bool{
+	"userState":         true,
+	"roomJoin":          true,
+	"roomLeave":         true,
+	"roomProof":         true,
+	"roomProofRejected": true,
+	"goodbye":           true,
+}
+
+// admitsMessage reports whether a peer with access may send msgType
+func admitsMessage(access PeerAccess, msgType string) bool {
+	return access.canSend() || (access.canConnect() && listenOnlyMessages[msgType])
+}
+
 func sendState(dc *webrtc.DataChannel, peerIP string) {
 	mirrorStateMu.RLock()
 	userStateMsg := map[string]interface{}{
@@ -19,6 +35,8 @@ func sendState(dc *webrtc.DataChannel, peerIP string) {
 	if jsonData, err := json.Marshal(userStateMsg); err == nil {
 		if err := dc.SendText(string(jsonData)); err != nil {
 			log.Printf("[RTC datachannel] Failed to send initial userState to %s: %v", peerIP, err)
+		} else {
+			metricDataChannelMessages.inc("out")
 		}
 	} else {
 		log.Printf("[RTC datachannel] Failed to marshal userState: %v", err)
@@ -32,6 +50,11 @@ func (rm *RTCManager) setupDataChannelHandlers(dc *webrtc.DataChannel, peerIP st
 		log.Printf("[RTC datachannel] Data channel %v opened", dc.Label())
 		// send userState asap
 		sendState(dc, peerIP)
+		rm.mu.RLock()
+		if connection, exists := rm.connections[peerIP]; exists {
+			go rm.sendRoomProof(connection, true)
+		}
+		rm.mu.RUnlock()
 
 		// a backup method
 		ticker = time.NewTicker(5 * time.Second)
@@ -51,18 +74,31 @@ func (rm *RTCManager) setupDataChannelHandlers(dc *webrtc.DataChannel, peerIP st
 	})
 
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		metricDataChannelMessages.inc("in")
+		access := peerAccess(peerIP)
+		if !access.canConnect() {
+			return
+		}
 		// log.Printf("[RTC datachannel] Message received on data channel %v: %s", dc.Label(), msg.Data)
 		if msg.IsString {
 			var jsonData interface{}
 			if err := json.Unmarshal(msg.Data, &jsonData); err != nil {
 				log.Printf("Failed to decode JSON: %v", err)
 			} else {
-				msgType := jsonData.(map[string]interface{})["type"]
+				msgType, _ := jsonData.(map[string]interface{})["type"].(string)
+				if !admitsMessage(access, msgType) {
+					log.Printf("[RTC dc] Dropping %s from listen-only peer %s", msgType, peerIP)
+					return
+				}
 				switch msgType {
 				case "userState":
 					if userStateData, ok := jsonData.(map[string]interface{})["userState"]; ok {
 						rm.updateIsInChat(peerIP, userStateData.(map[string]interface{}))
 					}
+					if !access.canSend() {
+						// membership only, a listener's state doesn't reach the frontend
+						return
+					}
 
 					jsonData.(map[string]interface{})["from"] = peerIP
 					modifiedData, err := json.Marshal(jsonData)
@@ -75,7 +111,28 @@ func (rm *RTCManager) setupDataChannelHandlers(dc *webrtc.DataChannel, peerIP st
 					if err != nil {
 						// 错误已经在 sendMsgWs 中处理和记录了
 					}
+				case "roomJoin":
+					room, _ := jsonData.(map[string]interface{})["room"].(string)
+					since, _ := jsonData.(map[string]interface{})["since"].(float64)
+					rm.setPeerRoom(peerIP, room != "", room)
+					rm.noteRoomSince(peerIP, room, int64(since))
+				case "roomLeave":
+					rm.setPeerRoom(peerIP, false, "")
+				case "roomProof":
+					rm.handleRoomProof(peerIP, msg.Data)
+				case "roomProofRejected":
+					room, _ := jsonData.(map[string]interface{})["room"].(string)
+					log.Printf("[rooms] %s rejected our proof for room %s", peerIP, room)
+					reportRoomRejected(peerIP, room, "rejected_by_peer")
+				case "moderation":
+					rm.handleModeration(peerIP, msg.Data)
+				case "goodbye":
+					go removeLeavingPeer(peerIP, "goodbye")
 				case "dm":
+					if room, isRoomChat := jsonData.(map[string]interface{})["room"].(string); isRoomChat && !rm.admitsPeer(peerIP, room) {
+						log.Printf("[RTC dc] Dropping room chat from %s, not admitted to %s", peerIP, room)
+						return
+					}
 					jsonData.(map[string]interface{})["from"] = peerIP
 					modifiedData, err := json.Marshal(jsonData)
 					if err != nil {
@@ -110,6 +167,8 @@ func (rm *RTCManager) broadcastUserState(latestMirrorState PeerState) {
 			if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
 				if err := dc.SendText(string(jsonData)); err != nil {
 					log.Printf("[RTC dc] Failed to broadcast userState to %s: %v", peerIP, err)
+				} else {
+					metricDataChannelMessages.inc("out")
 				}
 				log.Printf("[RTC dc] broadcasted userState to %s, by dc id: %d", peerIP, *dc.ID())
 			} else {
@@ -121,24 +180,16 @@ func (rm *RTCManager) broadcastUserState(latestMirrorState PeerState) {
 	}
 }
 
-// updateIsInChat 根据接收到的userState更新连接的isInChat状态
+// updateIsInChat 根据接收到的userState更新连接的isInChat状态和房间
 func (rm *RTCManager) updateIsInChat(peerIP string, userState map[string]interface{}) {
-	rm.mu.RLock()
-	connection, exists := rm.connections[peerIP]
-	rm.mu.RUnlock()
-
-	if !exists {
-		return
-	}
-
-	connection.mu.Lock()
-	defer connection.mu.Unlock()
-
 	isInChat, ok := userState["isInChat"].(bool)
 	if !ok {
 		log.Printf("[RTC dc] Failed to get isInChat status for peer %s: value is not a boolean", peerIP)
 		return
 	}
-	connection.isInChat = isInChat
+	room, _ := userState["room"].(string)
+	since, _ := userState["roomSince"].(float64)
 
+	rm.setPeerRoom(peerIP, isInChat, room)
+	rm.noteRoomSince(peerIP, room, int64(since))
 }
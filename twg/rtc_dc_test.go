@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestAdmitsMessage(t *testing.T) {
+	join := PeerAccess{Roles: []PeerRole{ROLE_JOIN}}
+	listenOnly := PeerAccess{Roles: []PeerRole{ROLE_LISTEN_ONLY}}
+	none := PeerAccess{}
+
+	tests := []struct {
+		access  PeerAccess
+		msgType string
+		want    bool
+	}{
+		{join, "dm", true},
+		{join, "moderation", true},
+		{join, "userState", true},
+		{listenOnly, "dm", false},
+		{listenOnly, "moderation", false},
+		{listenOnly, "userState", true},
+		{listenOnly, "roomJoin", true},
+		{listenOnly, "goodbye", true},
+		{listenOnly, "", false},
+		{none, "roomJoin", false},
+		{none, "goodbye", false},
+	}
+	for _, tt := range tests {
+		if got := admitsMessage(tt.access, tt.msgType); got != tt.want {
+			t.Errorf("admitsMessage(%v, %q) = %t, want %t", tt.access.Roles, tt.msgType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp/codecs/vp9"
+	"github.com/pion/webrtc/v4"
+)
+
+// frame dimensions: the resolution of a received keyframe, for the video frame
+// header. VP9 and VP8 carry it in the frame header, H.264 in the SPS and AV1
+// in the sequence header OBU, which encoders send with every keyframe. for
+// AV1 it is the sequence's maximum frame size, which is the frame size unless
+// the encoder scales frames down within the sequence.
+
+const (
+	h264NALUSPS      = 7
+	av1OBUSeqHeader  = 1
+	maxExpGolombBits = 31
+)
+
+// frameDimensions reads the resolution from a depacketized keyframe
+func frameDimensions(mimeType string, frame []byte) (width uint16, height uint16, ok bool) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		var header vp9.Header
+		if header.Unmarshal(frame) != nil || header.NonKeyFrame {
+			return 0, 0, false
+		}
+		return header.Width(), header.Height(), true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// 3 byte frame tag, 3 byte start code, then 14 bit width and height
+		if len(frame) < 10 || frame[0]&0x01 != 0 {
+			return 0, 0, false
+		}
+		width = binary.LittleEndian.Uint16(frame[6:8]) & 0x3FFF
+		height = binary.LittleEndian.Uint16(frame[8:10]) & 0x3FFF
+		return width, height, true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		for _, nalu := range bytes.Split(frame, []byte{0, 0, 1}) {
+			if len(nalu) > 0 && nalu[0]&0x1F == h264NALUSPS {
+				return h264SPSDimensions(nalu[1:])
+			}
+		}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		if payload := av1OBU(frame, av1OBUSeqHeader); payload != nil {
+			return av1SequenceDimensions(payload)
+		}
+	}
+	return 0, 0, false
+}
+
+// bitReader reads big endian bit fields, reads past the end set err
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  bool
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for range n {
+		if r.pos >= len(r.data)*8 {
+			r.err = true
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// ue is an unsigned exp-Golomb code, as in H.264
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err || zeros == maxExpGolombBits {
+			r.err = true
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se is a signed exp-Golomb code
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&1 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// uvlc is AV1's variable length code
+func (r *bitReader) uvlc() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err {
+			return 0
+		}
+		zeros++
+	}
+	if zeros >= 32 {
+		return 1<<32 - 1
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// unescapeRBSP removes the emulation prevention bytes of a NAL unit
+func unescapeRBSP(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// h264SPSDimensions parses an SPS after its NAL header for the cropped frame size
+func h264SPSDimensions(sps []byte) (width uint16, height uint16, ok bool) {
+	r := &bitReader{data: unescapeRBSP(sps)}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlanes := false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlanes = r.flag()
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.bits(1) // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := range lists {
+				if !r.flag() {
+					continue
+				}
+				if i < 6 {
+					skipScalingList(r, 16) // 4x4
+				} else {
+					skipScalingList(r, 64) // 8x8
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for range min(r.ue(), 255) {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMBs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMBsOnly := r.flag()
+	if !frameMBsOnly {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err {
+		return 0, 0, false
+	}
+
+	fieldFactor := uint32(2)
+	if frameMBsOnly {
+		fieldFactor = 1
+	}
+	cropUnitX, cropUnitY := uint32(1), fieldFactor
+	if !separateColourPlanes && chromaFormat != 0 {
+		subWidth, subHeight := uint32(2), uint32(2) // 4:2:0
+		switch chromaFormat {
+		case 2:
+			subHeight = 1
+		case 3:
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX, cropUnitY = subWidth, subHeight*fieldFactor
+	}
+
+	w := widthMBs*16 - cropUnitX*(cropLeft+cropRight)
+	h := heightMapUnits*16*fieldFactor - cropUnitY*(cropTop+cropBottom)
+	if w == 0 || h == 0 || w > 0xFFFF || h > 0xFFFF {
+		return 0, 0, false
+	}
+	return uint16(w), uint16(h), true
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for range size {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+		if r.err {
+			return
+		}
+	}
+}
+
+// av1OBU returns the payload of the first OBU of obuType in a temporal unit
+func av1OBU(frame []byte, obuType uint8) []byte {
+	for pos := 0; pos < len(frame); {
+		header := frame[pos]
+		pos++
+		if header&0x04 != 0 {
+			pos++ // extension
+		}
+		if pos > len(frame) {
+			return nil
+		}
+		size := uint64(len(frame) - pos) // without a size field the OBU runs to the end
+		if header&0x02 != 0 {
+			var n int
+			size, n = leb128(frame[pos:])
+			if n == 0 {
+				return nil
+			}
+			pos += n
+		}
+		if size > uint64(len(frame)-pos) {
+			return nil
+		}
+		if header>>3&0x0F == obuType {
+			return frame[pos : pos+int(size)]
+		}
+		pos += int(size)
+	}
+	return nil
+}
+
+// av1SequenceDimensions parses a sequence header OBU for the maximum frame size
+func av1SequenceDimensions(seq []byte) (width uint16, height uint16, ok bool) {
+	r := &bitReader{data: seq}
+	r.bits(3) // seq_profile
+	r.bits(1) // still_picture
+	if r.flag() {
+		// reduced_still_picture_header
+		r.bits(5) // seq_level_idx
+	} else {
+		decoderModelInfo := false
+		bufferDelayLength := 0
+		if r.flag() {
+			// timing_info
+			r.bits(32) // num_units_in_display_tick
+			r.bits(32) // time_scale
+			if r.flag() {
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			if decoderModelInfo = r.flag(); decoderModelInfo {
+				bufferDelayLength = int(r.bits(5)) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(5)  // buffer_removal_time_length_minus_1
+				r.bits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.flag()
+		operatingPoints := int(r.bits(5)) + 1
+		for range operatingPoints {
+			r.bits(12) // operating_point_idc
+			if r.bits(5) > 7 {
+				r.bits(1) // seq_tier
+			}
+			if decoderModelInfo && r.flag() {
+				r.bits(bufferDelayLength) // decoder_buffer_delay
+				r.bits(bufferDelayLength) // encoder_buffer_delay
+				r.bits(1)                 // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.flag() {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+			if r.err {
+				return 0, 0, false
+			}
+		}
+	}
+
+	widthBits := int(r.bits(4)) + 1
+	heightBits := int(r.bits(4)) + 1
+	w := r.bits(widthBits) + 1
+	h := r.bits(heightBits) + 1
+	if r.err || w > 0xFFFF || h > 0xFFFF {
+		return 0, 0, false
+	}
+	return uint16(w), uint16(h), true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// bitWriter builds the bitstreams bitReader parses
+type bitWriter struct {
+	data []byte
+	n    int // bits written
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for v>>n > 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// h264SPS is an SPS NAL unit for a 4:2:0 progressive stream
+func h264SPS(profile uint32, widthMBs, heightMBs, cropBottom uint32) []byte {
+	w := &bitWriter{}
+	w.bits(0x67, 8) // NAL header, type 7
+	w.bits(profile, 8)
+	w.bits(0, 8)  // constraint flags
+	w.bits(40, 8) // level
+	w.ue(0)       // seq_parameter_set_id
+	if profile == 100 {
+		w.ue(1)      // chroma_format_idc
+		w.ue(0)      // bit_depth_luma_minus8
+		w.ue(0)      // bit_depth_chroma_minus8
+		w.bits(0, 1) // qpprime_y_zero_transform_bypass_flag
+		w.bits(0, 1) // seq_scaling_matrix_present_flag
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(0) // pic_order_cnt_type
+	w.ue(0) // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1) // max_num_ref_frames
+	w.bits(0, 1)
+	w.ue(widthMBs - 1)
+	w.ue(heightMBs - 1)
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	if cropBottom > 0 {
+		w.bits(1, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.bits(0, 1)
+	}
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return w.data
+}
+
+// av1SequenceHeader is a temporal delimiter and a sequence header OBU
+func av1SequenceHeader(width, height uint32) []byte {
+	w := &bitWriter{}
+	w.bits(0, 3)  // seq_profile
+	w.bits(0, 1)  // still_picture
+	w.bits(0, 1)  // reduced_still_picture_header
+	w.bits(0, 1)  // timing_info_present_flag
+	w.bits(0, 1)  // initial_display_delay_present_flag
+	w.bits(0, 5)  // operating_points_cnt_minus_1
+	w.bits(0, 12) // operating_point_idc
+	w.bits(8, 5)  // seq_level_idx
+	w.bits(0, 1)  // seq_tier
+	w.bits(15, 4) // frame_width_bits_minus_1
+	w.bits(15, 4) // frame_height_bits_minus_1
+	w.bits(width-1, 16)
+	w.bits(height-1, 16)
+
+	unit := []byte{0x12, 0x00} // temporal delimiter
+	unit = append(unit, 0x0A, byte(len(w.data)))
+	return append(unit, w.data...)
+}
+
+func TestFrameDimensions(t *testing.T) {
+	idr := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84}
+	annexB := func(nalu []byte) []byte {
+		return append(append([]byte{0, 0, 0, 1}, nalu...), idr...)
+	}
+
+	tests := []struct {
+		name          string
+		mimeType      string
+		frame         []byte
+		width, height uint16
+		ok            bool
+	}{
+		{"h264 baseline cropped", webrtc.MimeTypeH264, annexB(h264SPS(66, 120, 68, 4)), 1920, 1080, true},
+		{"h264 high", webrtc.MimeTypeH264, annexB(h264SPS(100, 80, 45, 0)), 1280, 720, true},
+		{"h264 without sps", webrtc.MimeTypeH264, idr, 0, 0, false},
+		{"h264 truncated sps", webrtc.MimeTypeH264, annexB(h264SPS(66, 120, 68, 4)[:6]), 0, 0, false},
+		{"av1", webrtc.MimeTypeAV1, av1SequenceHeader(1920, 1080), 1920, 1080, true},
+		{"av1 without sequence header", webrtc.MimeTypeAV1, []byte{0x12, 0x00, 0x32, 0x01, 0x00}, 0, 0, false},
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0xE0, 0x01}, 640, 480, true},
+		{"vp8 delta", webrtc.MimeTypeVP8, []byte{0x11, 0x02, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0xE0, 0x01}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height, ok := frameDimensions(tt.mimeType, tt.frame)
+			if width != tt.width || height != tt.height || ok != tt.ok {
+				t.Fatalf("got %dx%d %t, want %dx%d %t", width, height, ok, tt.width, tt.height, tt.ok)
+			}
+		})
+	}
+}
@@ -14,13 +14,26 @@ type BER struct {
 
 var audioBitrateList = []uint32{32000, 64000, 128000}
 var videoBitrateList = []uint32{300000, 1000000, 5000000}
+var cameraBitrateList = []uint32{150000, 500000, 1500000}
+
+// highestBitrateWithin 选择不超过 budget 的最高码率, 都超过时用最低码率
+func highestBitrateWithin(bitrateList []uint32, budget uint32) uint32 {
+	for i := len(bitrateList) - 1; i >= 0; i-- {
+		if bitrateList[i] <= budget {
+			return bitrateList[i]
+		}
+	}
+	return bitrateList[0]
+}
 
 // calculateBitrateAllocation 根据可用总带宽和活跃轨道计算码率分配
 func calculateBitrateAllocation(totalBitrate int, activeStreams map[uint8]bool) map[uint8]uint32 {
 	bitrates := make(map[uint8]uint32)
 
 	// 检查是否有视频流
-	hasVideo := activeStreams[SCREEN_SHARE_VIDEO]
+	hasScreen := activeStreams[SCREEN_SHARE_VIDEO]
+	hasCamera := activeStreams[CAMERA_VIDEO]
+	hasVideo := hasScreen || hasCamera
 	hasMicrophone := activeStreams[MICROPHONE_AUDIO]
 	hasCPA := activeStreams[CPA_AUDIO]
 
@@ -42,16 +55,22 @@ func calculateBitrateAllocation(totalBitrate int, activeStreams map[uint8]bool)
 			audioConsumption += audioBitrateList[0]
 		}
 
-		// 剩余带宽分配给视频，选择最高可用码率
-		remainingBitrate := uint32(totalBitrate) - audioConsumption
-		videoBitrate := videoBitrateList[0] // 默认最低视频码率
-		for i := len(videoBitrateList) - 1; i >= 0; i-- {
-			if videoBitrateList[i] <= remainingBitrate {
-				videoBitrate = videoBitrateList[i]
-				break
-			}
+		// 剩余带宽分配给视频, 同时共享屏幕和摄像头时屏幕占 2/3
+		remainingBitrate := uint32(0)
+		if uint32(totalBitrate) > audioConsumption {
+			remainingBitrate = uint32(totalBitrate) - audioConsumption
+		}
+		screenBudget, cameraBudget := remainingBitrate, remainingBitrate
+		if hasScreen && hasCamera {
+			screenBudget = remainingBitrate / 3 * 2
+			cameraBudget = remainingBitrate - screenBudget
+		}
+		if hasScreen {
+			bitrates[SCREEN_SHARE_VIDEO] = highestBitrateWithin(videoBitrateList, screenBudget)
+		}
+		if hasCamera {
+			bitrates[CAMERA_VIDEO] = highestBitrateWithin(cameraBitrateList, cameraBudget)
 		}
-		bitrates[SCREEN_SHARE_VIDEO] = videoBitrate
 
 	} else if hasMicrophone && hasCPA {
 		// 只有音频流，两个音频流均分带宽
@@ -135,6 +154,9 @@ func (rm *RTCManager) reportBandwidthEstimates() {
 				if mirrorState.IsSharingScreen {
 					activeStreams[SCREEN_SHARE_VIDEO] = true
 				}
+				if mirrorState.IsSharingCamera {
+					activeStreams[CAMERA_VIDEO] = true
+				}
 				mirrorStateMu.RUnlock()
 
 				// 使用新的码率分配策略
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// video frame header: every video frame on the media websocket carries one, in
+// both directions, right after the routing prefix ([trackID] from the
+// frontend, mediaHeader to it). all fields little endian:
+//
+//	[1B codec][1B flags][1B layer][8B capture timestamp µs][4B RTP timestamp][2B width][2B height]
+//
+// the codec is a CODEC_* ID and the flags are the CHUNK_FLAG_* bits. from the
+// frontend the layer is the simulcast layer, the capture timestamp is the
+// VideoFrame's and the RTP timestamp is 0, the gateway derives it from the
+// capture timestamp. to the frontend the layer is the VP9 spatial layer, the
+// capture timestamp is the RTP timestamp on the local clock in unix µs, and
+// width and height are 0 until the gateway finds them in a keyframe.
+
+const VIDEO_FRAME_HEADER_SIZE = 19
+
+type videoFrameHeader struct {
+	codec        uint8
+	flags        uint8
+	layer        uint8
+	captureTime  uint64 // µs
+	rtpTimestamp uint32
+	width        uint16
+	height       uint16
+}
+
+var errShortFrameHeader = errors.New("video frame shorter than its header")
+
+// parseVideoFrameHeader splits a video frame after its routing prefix into the header and the frame
+func parseVideoFrameHeader(data []byte) (videoFrameHeader, []byte, error) {
+	if len(data) <= VIDEO_FRAME_HEADER_SIZE {
+		return videoFrameHeader{}, nil, errShortFrameHeader
+	}
+	h := videoFrameHeader{
+		codec:        data[0],
+		flags:        data[1],
+		layer:        data[2],
+		captureTime:  binary.LittleEndian.Uint64(data[3:11]),
+		rtpTimestamp: binary.LittleEndian.Uint32(data[11:15]),
+		width:        binary.LittleEndian.Uint16(data[15:17]),
+		height:       binary.LittleEndian.Uint16(data[17:19]),
+	}
+	return h, data[VIDEO_FRAME_HEADER_SIZE:], nil
+}
+
+func (h videoFrameHeader) keyframe() bool {
+	return h.flags&CHUNK_FLAG_KEYFRAME != 0
+}
+
+func (h videoFrameHeader) appendTo(b []byte) []byte {
+	b = append(b, h.codec, h.flags, h.layer)
+	b = binary.LittleEndian.AppendUint64(b, h.captureTime)
+	b = binary.LittleEndian.AppendUint32(b, h.rtpTimestamp)
+	b = binary.LittleEndian.AppendUint16(b, h.width)
+	return binary.LittleEndian.AppendUint16(b, h.height)
+}
+
+// videoMediaHeader is mediaHeader plus the video frame header
+func videoMediaHeader(trackID uint8, peerIP string, h videoFrameHeader, payloadSize int) []byte {
+	header := mediaHeader(trackID, peerIP, VIDEO_FRAME_HEADER_SIZE+payloadSize)
+	return h.appendTo(header)
+}
+
+// captureRTPTimestamp is the 90kHz RTP timestamp of a capture timestamp.
+// whole seconds and the rest are scaled apart so the product can't overflow
+func captureRTPTimestamp(captureTime uint64) uint32 {
+	const usPerSecond = uint64(time.Second / time.Microsecond)
+	seconds, us := captureTime/usPerSecond, captureTime%usPerSecond
+	return uint32(seconds*vp9ClockRate + us*vp9ClockRate/usPerSecond)
+}
+
+const (
+	defaultFrameDuration = time.Second / 30
+	maxFrameDuration     = time.Second
+)
+
+// frameDurations remembers the last capture timestamp per track and layer, so
+// samples are paced by the frontend's capture clock instead of a fixed rate
+var frameDurations = struct {
+	lastCapture map[[2]uint8]uint64 // key is track.ID and layer
+	mu          sync.Mutex
+}{lastCapture: make(map[[2]uint8]uint64)}
+
+// frameDuration is the time since the previous frame of the same track and layer
+func frameDuration(trackID uint8, h videoFrameHeader) time.Duration {
+	frameDurations.mu.Lock()
+	defer frameDurations.mu.Unlock()
+
+	key := [2]uint8{trackID, h.layer}
+	last, seen := frameDurations.lastCapture[key]
+	frameDurations.lastCapture[key] = h.captureTime
+	if !seen || h.captureTime <= last {
+		return defaultFrameDuration
+	}
+	d := time.Duration(h.captureTime-last) * time.Microsecond
+	if d > maxFrameDuration {
+		// the track was paused, don't stretch the first frame after it
+		return defaultFrameDuration
+	}
+	return d
+}
+
+// rtpClock maps a received track's RTP timestamps onto the local clock
+type rtpClock struct {
+	started bool
+	base    time.Time
+	last    uint32
+	elapsed int64 // ticks since base, unwrapped
+}
+
+// captureTime is the local unix time in µs of an RTP timestamp
+func (c *rtpClock) captureTime(timestamp uint32) uint64 {
+	if !c.started {
+		c.started = true
+		c.base = time.Now()
+		c.last = timestamp
+	}
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+	return uint64(c.base.UnixMicro() + c.elapsed*int64(time.Second/time.Microsecond)/vp9ClockRate)
+}
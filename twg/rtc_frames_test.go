@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVideoFrameHeaderRoundTrip(t *testing.T) {
+	h := videoFrameHeader{
+		codec:        CODEC_AV1,
+		flags:        CHUNK_FLAG_KEYFRAME | CHUNK_FLAG_SVC | 2<<svcTemporalShift,
+		layer:        2,
+		captureTime:  1_700_000_000_123_456,
+		rtpTimestamp: 0xDEADBEEF,
+		width:        1920,
+		height:       1080,
+	}
+	frame := []byte{0x12, 0x00, 0x0A}
+
+	data := append(h.appendTo(nil), frame...)
+	if len(data) != VIDEO_FRAME_HEADER_SIZE+len(frame) {
+		t.Fatalf("got %d bytes, want a %d byte header", len(data)-len(frame), VIDEO_FRAME_HEADER_SIZE)
+	}
+	parsed, rest, err := parseVideoFrameHeader(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != h {
+		t.Fatalf("got %+v, want %+v", parsed, h)
+	}
+	if !bytes.Equal(rest, frame) {
+		t.Fatalf("got frame %x, want %x", rest, frame)
+	}
+	if !parsed.keyframe() || chunkSVC(parsed.flags).tid != 2 {
+		t.Fatalf("flags %08b lost the keyframe or temporal ID", parsed.flags)
+	}
+}
+
+func TestParseVideoFrameHeaderShort(t *testing.T) {
+	// a header without a frame is as useless as a truncated one
+	for _, size := range []int{0, 1, VIDEO_FRAME_HEADER_SIZE - 1, VIDEO_FRAME_HEADER_SIZE} {
+		if _, _, err := parseVideoFrameHeader(make([]byte, size)); !errors.Is(err, errShortFrameHeader) {
+			t.Errorf("%d bytes: got %v, want errShortFrameHeader", size, err)
+		}
+	}
+}
+
+func TestCaptureRTPTimestamp(t *testing.T) {
+	tests := []struct {
+		captureTime uint64
+		want        uint32
+	}{
+		{0, 0},
+		{1_000_000, vp9ClockRate},
+		{33_333, 2999},
+		// unix µs timestamps, times the clock rate they overflow uint64
+		{1_760_000_000_000_000, 1606123520}, // 1760000000 * 90000 mod 2^32
+		{1_760_000_000_500_000, 1606168520},
+	}
+	for _, tt := range tests {
+		if got := captureRTPTimestamp(tt.captureTime); got != tt.want {
+			t.Errorf("captureRTPTimestamp(%d) = %d, want %d", tt.captureTime, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// trickle ICE: candidates are posted one by one to /ice_candidate as soon as
+// they are gathered, instead of waiting for gathering to complete and bundling
+// them with the sdp. peers that don't advertise TrickleICE in NodeInfo keep
+// using the bundled /offer_ice and /answer_ice flow.
+
+// max number of candidates kept for a peer whose offer has not arrived yet
+const maxEarlyCandidates = 64
+
+type ICECandidatePayload struct {
+	From      string                  `json:"from"`
+	SessionID string                  `json:"sessionId,omitempty"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+func (rm *RTCManager) sendCandidateViaTS(targetIP string, sessionID string, candidate *webrtc.ICECandidate) {
+	payload := ICECandidatePayload{
+		From:      nodeInfo.TailscaleIP,
+		SessionID: sessionID,
+		Candidate: candidate.ToJSON(),
+	}
+
+	if _, err := rm.postSignaling(targetIP, "ice_candidate", payload); err != nil {
+		log.Printf("[RTC] Failed to send ICE candidate to %s: %v", targetIP, err)
+	}
+}
+
+// flushLocalCandidates marks the local description as delivered and sends
+// every candidate gathered in the meantime
+func (rm *RTCManager) flushLocalCandidates(connection *RTCConnection) {
+	connection.candidatesMu.Lock()
+	defer connection.candidatesMu.Unlock()
+
+	connection.localDescSent = true
+	for _, candidate := range connection.pendingCandidates {
+		go rm.sendCandidateViaTS(connection.peerIP, connection.sessionID, candidate)
+	}
+	connection.pendingCandidates = connection.pendingCandidates[:0]
+}
+
+// HandleRemoteCandidate applies a trickled candidate, or buffers it until the
+// matching remote description is set
+func (rm *RTCManager) HandleRemoteCandidate(payload ICECandidatePayload) error {
+	peerIP := payload.From
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	connection, exists := rm.connections[peerIP]
+	if exists && payload.SessionID != "" {
+		connection.mu.RLock()
+		exists = connection.sessionID == payload.SessionID
+		connection.mu.RUnlock()
+	}
+	if !exists {
+		// offer is still on its way or being processed
+		if len(rm.earlyCandidates[peerIP]) >= maxEarlyCandidates {
+			return fmt.Errorf("[RTC] too many early ICE candidates from %s", peerIP)
+		}
+		rm.earlyCandidates[peerIP] = append(rm.earlyCandidates[peerIP], payload)
+		return nil
+	}
+
+	return connection.addRemoteCandidate(payload.Candidate)
+}
+
+func (c *RTCConnection) addRemoteCandidate(candidate webrtc.ICECandidateInit) error {
+	c.candidatesMu.Lock()
+	defer c.candidatesMu.Unlock()
+
+	if !c.remoteDescSet {
+		c.remoteCandidates = append(c.remoteCandidates, candidate)
+		return nil
+	}
+	return c.pc.AddICECandidate(candidate)
+}
+
+// markRemoteDescriptionSet must be called right after SetRemoteDescription,
+// it adds the given early candidates and everything buffered on the connection
+func (c *RTCConnection) markRemoteDescriptionSet(early []webrtc.ICECandidateInit) error {
+	c.candidatesMu.Lock()
+	defer c.candidatesMu.Unlock()
+
+	c.remoteDescSet = true
+	buffered := append(early, c.remoteCandidates...)
+	c.remoteCandidates = nil
+
+	var firstErr error
+	for _, candidate := range buffered {
+		if err := c.pc.AddICECandidate(candidate); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// keyframe requests: PLI and FIR from receivers of a video track, a peer that
+// starts receiving a video track mid-stream and a peer that waits for another
+// simulcast layer all need a keyframe from the frontend's encoder. a request
+// names the codec and simulcast layer the peer receives, so only that encoder
+// is keyed. requests are collected per track, codec and layer and sent to the
+// frontend as one requestKeyframe message at most every
+// keyframeRequestInterval. on the receive side, a frame lost in reassembly is
+// answered with a PLI to the sending peer, see rtc_reassembly.go.
+
+var keyframeRequestInterval = 500 * time.Millisecond
+
+type keyframeRequestMsg struct {
+	Type    string   `json:"type"`
+	TrackID uint8    `json:"trackID"`
+	Codec   uint8    `json:"codec"`   // CODEC_* of the encoder to key
+	Layer   int      `json:"layer"`   // simulcast layer of the encoder to key
+	Peers   []string `json:"peers"`   // peers waiting for the keyframe
+	Reasons []string `json:"reasons"` // pli, fir, join, layer
+}
+
+// keyframeKey names one encoder of the frontend
+type keyframeKey struct {
+	trackID uint8
+	codec   uint8
+	layer   int
+}
+
+type pendingKeyframe struct {
+	peers     []string
+	reasons   []string
+	scheduled bool // a send is waiting for the interval to pass
+}
+
+var keyframeRequests = struct {
+	pending  map[keyframeKey]*pendingKeyframe
+	lastSent map[keyframeKey]time.Time
+	mu       sync.Mutex
+}{pending: make(map[keyframeKey]*pendingKeyframe), lastSent: make(map[keyframeKey]time.Time)}
+
+// videoCodecLocked is the CODEC_* the connection receives trackID in, caller
+// must hold connection.mu
+func videoCodecLocked(connection *RTCConnection, trackID uint8) uint8 {
+	mimeType := trackMap[trackID].MimeType
+	if trackID == SCREEN_SHARE_VIDEO {
+		mimeType = connection.screenCodec
+	}
+	id, _ := codecID(mimeType)
+	return id
+}
+
+// requestKeyframe asks the frontend for a keyframe of trackID's encoder for
+// codec and layer on behalf of peerIP
+func requestKeyframe(trackID uint8, codec uint8, layer int, peerIP string, reason string) {
+	keyframeRequests.mu.Lock()
+	defer keyframeRequests.mu.Unlock()
+
+	key := keyframeKey{trackID: trackID, codec: codec, layer: layer}
+	request, exists := keyframeRequests.pending[key]
+	if !exists {
+		request = &pendingKeyframe{}
+		keyframeRequests.pending[key] = request
+	}
+	if !slices.Contains(request.peers, peerIP) {
+		request.peers = append(request.peers, peerIP)
+	}
+	if !slices.Contains(request.reasons, reason) {
+		request.reasons = append(request.reasons, reason)
+	}
+	if request.scheduled {
+		return
+	}
+
+	wait := keyframeRequestInterval - time.Since(keyframeRequests.lastSent[key])
+	request.scheduled = true
+	if wait <= 0 {
+		go sendKeyframeRequest(key)
+		return
+	}
+	time.AfterFunc(wait, func() { sendKeyframeRequest(key) })
+}
+
+// sendKeyframeRequest sends the requests collected for an encoder to the frontend
+func sendKeyframeRequest(key keyframeKey) {
+	keyframeRequests.mu.Lock()
+	request, exists := keyframeRequests.pending[key]
+	if !exists {
+		keyframeRequests.mu.Unlock()
+		return
+	}
+	delete(keyframeRequests.pending, key)
+	keyframeRequests.lastSent[key] = time.Now()
+	keyframeRequests.mu.Unlock()
+
+	for _, reason := range request.reasons {
+		metricKeyframeRequests.inc(reason)
+	}
+	msg := keyframeRequestMsg{
+		Type:    "requestKeyframe",
+		TrackID: key.trackID,
+		Codec:   key.codec,
+		Layer:   key.layer,
+		Peers:   request.peers,
+		Reasons: request.reasons,
+	}
+	if jsonData, err := json.Marshal(msg); err == nil {
+		sendMsgWs(jsonData)
+	}
+}
+
+// handleVideoSenderRTCP is handleRTCP for the sender of a video track, PLI and
+// FIR from the connection's peer become keyframe requests for the layer it gets
+func handleVideoSenderRTCP(connection *RTCConnection, trackID uint8, sender *webrtc.RTPSender) {
+	label := "sender:" + trackLabel(trackID)
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			log.Printf("[RTCP][%s] reader closed: %v", label, err)
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication:
+				requestReceivedKeyframe(connection, trackID, "pli")
+			case *rtcp.FullIntraRequest:
+				requestReceivedKeyframe(connection, trackID, "fir")
+			}
+		}
+	}
+}
+
+// requestReceivedKeyframe asks for a keyframe of the layer the connection
+// gets. before its first layer forwardLayer already asks for one.
+func requestReceivedKeyframe(connection *RTCConnection, trackID uint8, reason string) {
+	connection.mu.RLock()
+	codec := videoCodecLocked(connection, trackID)
+	connection.simulcastMu.Lock()
+	layer, started := connection.videoLayers[trackID]
+	connection.simulcastMu.Unlock()
+	connection.mu.RUnlock()
+
+	if started {
+		requestKeyframe(trackID, codec, layer, connection.peerIP, reason)
+	}
+}
+
+// pliInterval is the least time between two PLIs for a received track
+var pliInterval = 500 * time.Millisecond
+
+// pliSender asks the sending peer of a received video track for keyframes
+type pliSender struct {
+	pc      *webrtc.PeerConnection
+	ssrc    uint32
+	lastPLI time.Time
+}
+
+// sendPLI asks the sending peer for a keyframe, at most every pliInterval
+func (s *pliSender) sendPLI(label string) {
+	if s.pc == nil || time.Since(s.lastPLI) < pliInterval {
+		return
+	}
+	s.lastPLI = time.Now()
+	if err := s.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: s.ssrc}}); err != nil {
+		log.Printf("[RTCP][%s] Failed to send PLI: %v", label, err)
+		return
+	}
+	metricKeyframeRequests.inc("pli_sent")
+}
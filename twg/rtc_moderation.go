@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// moderation: a peer with the moderate role, or the peer it handed the room
+// to, can mute, kick and lock. actions go to every peer over the data channel
+// and each gateway enforces them itself. the muted peer's gateway stops sending
+// its microphone, and receivers drop its frames too in case it doesn't. a
+// kicked peer leaves the room and is kept out for kickBanDuration, a locked
+// room only admits the members it had when it was locked.
+//
+// the moderate role comes from the tailnet policy with --access-control. the
+// local node's own roles are the ones the policy grants it towards itself, the
+// grant's dst has to cover the moderators' nodes too. without access control
+// nobody has the role and a room's creator moderates it instead: the member in
+// it the longest, by the join time each node sends with its room. equal or
+// unknown join times go by address, so every gateway picks the same node.
+
+const (
+	MOD_MUTE_PEER          = "mute-peer"
+	MOD_UNMUTE_PEER        = "unmute-peer"
+	MOD_KICK_PEER          = "kick-peer"
+	MOD_LOCK_ROOM          = "lock-room"
+	MOD_UNLOCK_ROOM        = "unlock-room"
+	MOD_TRANSFER_MODERATOR = "transfer-moderator"
+)
+
+var kickBanDuration = 5 * time.Minute
+
+type moderationMsg struct {
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	Room   string `json:"room"`
+	Target string `json:"target,omitempty"`
+	From   string `json:"from,omitempty"`  // set for the frontend
+	Error  string `json:"error,omitempty"` // set for the frontend when the local user may not moderate
+}
+
+type roomModeration struct {
+	moderator string               // peerIP the room was transferred to, empty when none
+	locked    bool                 // only members may join
+	members   map[string]bool      // peerIPs in the room when it was locked
+	muted     map[string]bool      // peerIPs muted by a moderator
+	kicked    map[string]time.Time // peerIP to the end of its ban
+}
+
+type moderationState struct {
+	rooms map[string]*roomModeration // key is room ID
+	mu    sync.RWMutex
+}
+
+func newModerationState() moderationState {
+	return moderationState{rooms: make(map[string]*roomModeration)}
+}
+
+// roomLocked returns the moderation of room, creating it, caller must hold ms.mu
+func (ms *moderationState) roomLocked(room string) *roomModeration {
+	state, exists := ms.rooms[room]
+	if !exists {
+		state = &roomModeration{
+			muted:  make(map[string]bool),
+			kicked: make(map[string]time.Time),
+		}
+		ms.rooms[room] = state
+	}
+	return state
+}
+
+// bars reports whether moderation keeps peerIP out of room
+func (ms *moderationState) bars(room string, peerIP string) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	state, exists := ms.rooms[effectiveRoom(room)]
+	if !exists {
+		return false
+	}
+	if time.Now().Before(state.kicked[peerIP]) {
+		return true
+	}
+	return state.locked && !state.members[peerIP]
+}
+
+func (ms *moderationState) isMuted(room string, peerIP string) bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	state, exists := ms.rooms[effectiveRoom(room)]
+	return exists && state.muted[peerIP]
+}
+
+func (ms *moderationState) moderator(room string) string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if state, exists := ms.rooms[effectiveRoom(room)]; exists {
+		return state.moderator
+	}
+	return ""
+}
+
+// peerMuted is checked for every received microphone frame
+func (rm *RTCManager) peerMuted(peerIP string) bool {
+	rm.roster.mu.Lock()
+	room, inChat := rm.roster.peerRooms[peerIP]
+	rm.roster.mu.Unlock()
+	return inChat && rm.moderation.isMuted(room, peerIP)
+}
+
+// localMuted reports whether a moderator muted us in the local room
+func (rm *RTCManager) localMuted() bool {
+	return rm.moderation.isMuted(localRoom(), nodeInfo.TailscaleIP)
+}
+
+// moderate runs an action of the local user in the local room and sends it to the peers
+func (rm *RTCManager) moderate(action string, target string) {
+	msg := moderationMsg{Type: "moderation", Action: action, Room: localRoom(), Target: target}
+	if !validModeration(msg) {
+		log.Printf("[moderation] Invalid action %q for %q", action, target)
+		return
+	}
+	self := nodeInfo.TailscaleIP
+	if !rm.mayModerate(msg.Room, self) {
+		// every peer would reject it, don't show it as applied
+		log.Printf("[moderation] Not a moderator of room %s, ignoring %s", msg.Room, action)
+		msg.Error = "not a moderator of the room"
+		if jsonData, err := json.Marshal(msg); err == nil {
+			go sendMsgWs(jsonData)
+		}
+		return
+	}
+	log.Printf("[moderation] %s %s in room %s", action, target, msg.Room)
+
+	rm.applyModeration(msg, nodeInfo.TailscaleIP)
+	if jsonData, err := json.Marshal(msg); err == nil {
+		rm.sendToAllPeers(jsonData)
+	}
+}
+
+func validModeration(msg moderationMsg) bool {
+	switch msg.Action {
+	case MOD_LOCK_ROOM, MOD_UNLOCK_ROOM:
+		return true
+	case MOD_MUTE_PEER, MOD_UNMUTE_PEER, MOD_KICK_PEER, MOD_TRANSFER_MODERATOR:
+		return msg.Target != ""
+	}
+	return false
+}
+
+// mayModerate reports whether peerIP, which can be the local node, moderates room
+func (rm *RTCManager) mayModerate(room string, peerIP string) bool {
+	if peerAccess(peerIP).canModerate() || rm.moderation.moderator(room) == peerIP {
+		return true
+	}
+	return !accessControl && rm.roomCreator(room) == peerIP
+}
+
+type roomMember struct {
+	peerIP string
+	since  int64
+}
+
+// before orders members by how long they have been in the room
+func (m roomMember) before(other roomMember) bool {
+	if m.since != other.since {
+		if m.since == 0 || other.since == 0 {
+			return other.since == 0
+		}
+		return m.since < other.since
+	}
+	return m.peerIP < other.peerIP
+}
+
+// roomCreator is the member of room that has been in it the longest, the
+// local node included
+func (rm *RTCManager) roomCreator(room string) string {
+	room = effectiveRoom(room)
+	var members []roomMember
+
+	rm.roster.mu.Lock()
+	for peerIP := range rm.roster.rooms[room] {
+		members = append(members, roomMember{peerIP: peerIP, since: rm.roster.since[peerIP]})
+	}
+	rm.roster.mu.Unlock()
+
+	mirrorStateMu.RLock()
+	if mirrorState.IsInChat && effectiveRoom(mirrorState.Room) == room {
+		members = append(members, roomMember{peerIP: nodeInfo.TailscaleIP, since: mirrorState.RoomSince})
+	}
+	mirrorStateMu.RUnlock()
+
+	if len(members) == 0 {
+		return ""
+	}
+	creator := members[0]
+	for _, member := range members[1:] {
+		if member.before(creator) {
+			creator = member
+		}
+	}
+	return creator.peerIP
+}
+
+// handleModeration checks a moderation message from peerIP and applies it
+func (rm *RTCManager) handleModeration(peerIP string, data []byte) {
+	var msg moderationMsg
+	if err := json.Unmarshal(data, &msg); err != nil || !validModeration(msg) {
+		log.Printf("[moderation] Malformed moderation message from %s", peerIP)
+		return
+	}
+	msg.Room = effectiveRoom(msg.Room)
+
+	rm.roster.mu.Lock()
+	issuerRoom, inChat := rm.roster.peerRooms[peerIP]
+	rm.roster.mu.Unlock()
+
+	if !rm.mayModerate(msg.Room, peerIP) || !inChat || issuerRoom != msg.Room {
+		log.Printf("[moderation] Ignoring %s from %s in room %s: not a moderator of the room", msg.Action, peerIP, msg.Room)
+		return
+	}
+	rm.applyModeration(msg, peerIP)
+}
+
+// applyModeration updates the room's moderation state, from is the issuer
+func (rm *RTCManager) applyModeration(msg moderationMsg, from string) {
+	var members map[string]bool
+	if msg.Action == MOD_LOCK_ROOM {
+		rm.roster.mu.Lock()
+		members = make(map[string]bool, len(rm.roster.rooms[msg.Room])+1)
+		for peerIP := range rm.roster.rooms[msg.Room] {
+			members[peerIP] = true
+		}
+		rm.roster.mu.Unlock()
+		if localRoom() == msg.Room {
+			members[nodeInfo.TailscaleIP] = true
+		}
+	}
+
+	rm.moderation.mu.Lock()
+	state := rm.moderation.roomLocked(msg.Room)
+	switch msg.Action {
+	case MOD_MUTE_PEER:
+		state.muted[msg.Target] = true
+	case MOD_UNMUTE_PEER:
+		delete(state.muted, msg.Target)
+	case MOD_KICK_PEER:
+		state.kicked[msg.Target] = time.Now().Add(kickBanDuration)
+		delete(state.members, msg.Target)
+	case MOD_LOCK_ROOM:
+		state.locked = true
+		state.members = members
+	case MOD_UNLOCK_ROOM:
+		state.locked = false
+		state.members = nil
+	case MOD_TRANSFER_MODERATOR:
+		state.moderator = msg.Target
+	}
+	rm.moderation.mu.Unlock()
+
+	self := msg.Target == nodeInfo.TailscaleIP
+	if msg.Action == MOD_KICK_PEER && self && localRoom() == msg.Room {
+		log.Printf("[moderation] Kicked from room %s by %s", msg.Room, from)
+		go rm.joinRoom("", roomPolicy{})
+	}
+
+	msg.From = from
+	if jsonData, err := json.Marshal(msg); err == nil {
+		go sendMsgWs(jsonData)
+	}
+}
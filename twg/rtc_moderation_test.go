@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestRoomCreatorModerates(t *testing.T) {
+	self, state, enabled := nodeInfo.TailscaleIP, mirrorState, accessControl
+	t.Cleanup(func() {
+		nodeInfo.TailscaleIP, mirrorState, accessControl = self, state, enabled
+	})
+	nodeInfo.TailscaleIP = "100.64.0.1"
+	mirrorState = PeerState{IsInChat: true, Room: "standup", RoomSince: 2000}
+	accessControl = false
+
+	rm := &RTCManager{roster: newRoomRoster(), moderation: newModerationState()}
+	rm.updateRoster("100.64.0.2", true, "standup")
+	rm.noteRoomSince("100.64.0.2", "standup", 1000)
+	rm.updateRoster("100.64.0.3", true, "standup") // an older build, no join time
+	rm.updateRoster("100.64.0.4", true, "other")
+	rm.noteRoomSince("100.64.0.4", "other", 500)
+
+	if creator := rm.roomCreator("standup"); creator != "100.64.0.2" {
+		t.Fatalf("got creator %s, want the member that joined first", creator)
+	}
+	if !rm.mayModerate("standup", "100.64.0.2") || rm.mayModerate("standup", "100.64.0.1") || rm.mayModerate("standup", "100.64.0.4") {
+		t.Fatal("only the creator may moderate")
+	}
+
+	// the creator leaves, the next one in takes over
+	rm.removeFromRoster("100.64.0.2")
+	if !rm.mayModerate("standup", "100.64.0.1") {
+		t.Fatalf("got creator %s after the first left, want the local node", rm.roomCreator("standup"))
+	}
+
+	// rejoining a room resets the join time, the member without one comes last
+	rm.updateRoster("100.64.0.2", true, "standup")
+	rm.noteRoomSince("100.64.0.2", "standup", 3000)
+	if creator := rm.roomCreator("standup"); creator != "100.64.0.1" {
+		t.Fatalf("got creator %s, want the local node", creator)
+	}
+
+	// a transfer adds a moderator
+	rm.applyModeration(moderationMsg{Action: MOD_TRANSFER_MODERATOR, Room: "standup", Target: "100.64.0.3"}, "100.64.0.1")
+	if !rm.mayModerate("standup", "100.64.0.3") {
+		t.Fatal("the room was handed over but the new moderator can't moderate")
+	}
+
+	// with access control the role decides
+	accessControl = true
+	if rm.mayModerate("standup", "100.64.0.1") {
+		t.Fatal("the creator moderates with access control")
+	}
+}
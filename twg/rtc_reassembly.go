@@ -0,0 +1,223 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// frame reassembly: received video packets are put back in sequence order and
+// a frame is emitted as soon as every packet from its first one to the one
+// with the marker bit is there, instead of when the next frame begins. the
+// first packet is the depacketizer's partition head, on the base spatial layer
+// for VP9. a missing packet is waited for while fewer than reorderWindow
+// packets arrived after it and for at most reorderTimeout, then the frame it
+// belongs to is dropped and reported as a loss, so the caller can drop frames
+// until a keyframe and send a PLI. frames of any size complete as long as
+// nothing is missing.
+
+const (
+	reorderWindow  = 64                     // packets received past a missing one
+	reorderTimeout = 100 * time.Millisecond // wait for late or retransmitted packets
+)
+
+type bufferedPacket struct {
+	packet  *rtp.Packet
+	arrived time.Time
+	vp9     codecs.VP9Packet // parsed descriptor, VP9 only
+}
+
+// assembledFrame is a complete depacketized frame
+type assembledFrame struct {
+	data      []byte
+	timestamp uint32
+	svc       bool  // VP9 with layer indices
+	tid       uint8 // temporal layer of the picture
+	sid       uint8 // top spatial layer in the picture
+}
+
+type frameAssembler struct {
+	mimeType      string
+	vp9           bool
+	heads         rtp.Depacketizer          // only asked for partition heads
+	packets       map[int64]*bufferedPacket // key is the extended sequence number
+	started       bool
+	highest       int64 // highest extended sequence number seen
+	next          int64 // extended sequence number the next frame starts at
+	lastTimestamp uint32
+	haveLast      bool // lastTimestamp is set, a frame was emitted or dropped
+}
+
+func newFrameAssembler(mimeType string) *frameAssembler {
+	return &frameAssembler{
+		mimeType: mimeType,
+		vp9:      strings.EqualFold(mimeType, webrtc.MimeTypeVP9),
+		heads:    videoDepacketizer(mimeType),
+		packets:  make(map[int64]*bufferedPacket),
+	}
+}
+
+// push adds a received packet and returns the frames it completed, lost is
+// set when an incomplete frame had to be dropped
+func (a *frameAssembler) push(packet *rtp.Packet, now time.Time) (frames []assembledFrame, lost bool) {
+	seq := packet.SequenceNumber
+	if !a.started {
+		a.started = true
+		a.highest = int64(seq)
+		a.next = int64(seq)
+	}
+	ext := a.highest + int64(int16(seq-uint16(a.highest)))
+	if ext < a.next || a.packets[ext] != nil {
+		// a duplicate, or too late for a frame that was emitted or dropped
+		return nil, false
+	}
+	a.highest = max(a.highest, ext)
+
+	buffered := &bufferedPacket{packet: packet, arrived: now}
+	if a.vp9 {
+		if _, err := buffered.vp9.Unmarshal(packet.Payload); err != nil {
+			metricDroppedFrames.inc("depacketize")
+			return nil, false
+		}
+	}
+	a.packets[ext] = buffered
+
+	for {
+		if frame, complete, corrupt := a.popFrame(); complete {
+			frames = append(frames, frame)
+			continue
+		} else if corrupt {
+			lost = true
+			continue
+		}
+		if !a.stalled(now) {
+			return frames, lost
+		}
+		joining := !a.haveLast
+		a.skip()
+		if !joining {
+			// joining mid-frame at the start isn't a loss
+			lost = true
+			metricDroppedFrames.inc("incomplete_frame")
+		}
+	}
+}
+
+// isStart reports whether the packet at ext is the first of a frame
+func (a *frameAssembler) isStart(ext int64) bool {
+	p := a.packets[ext]
+	if p == nil || !a.heads.IsPartitionHead(p.packet.Payload) {
+		return false
+	}
+	// a VP9 picture starts on its base spatial layer
+	return !a.vp9 || !p.vp9.L || p.vp9.SID == 0
+}
+
+// popFrame emits the frame at the head of the buffer when it is complete.
+// corrupt is set when it was complete but didn't depacketize
+func (a *frameAssembler) popFrame() (frame assembledFrame, complete bool, corrupt bool) {
+	head := a.packets[a.next]
+	if head == nil || !a.isStart(a.next) {
+		return frame, false, false
+	}
+
+	end := a.next
+	for {
+		p := a.packets[end]
+		if p == nil {
+			return frame, false, false
+		}
+		if p.packet.Timestamp != head.packet.Timestamp {
+			// the marker of the previous packet was lost, the timestamp still ends the frame
+			end--
+			break
+		}
+		if p.packet.Marker {
+			break
+		}
+		end++
+	}
+
+	frame.timestamp = head.packet.Timestamp
+	depacketizer := videoDepacketizer(a.mimeType) // fresh, no fragments left over from a dropped frame
+	for ext := a.next; ext <= end; ext++ {
+		p := a.packets[ext]
+		data, err := depacketizer.Unmarshal(p.packet.Payload)
+		if err != nil {
+			corrupt = true
+		}
+		frame.data = append(frame.data, data...)
+		if a.vp9 && p.vp9.L {
+			frame.svc = true
+			frame.tid = p.vp9.TID
+			frame.sid = max(frame.sid, p.vp9.SID)
+		}
+		delete(a.packets, ext)
+	}
+	a.next = end + 1
+	a.lastTimestamp, a.haveLast = frame.timestamp, true
+
+	if corrupt {
+		metricDroppedFrames.inc("depacketize")
+		return assembledFrame{}, false, true
+	}
+	return frame, true, false
+}
+
+// stalled reports whether the frame at the head of the buffer can't complete
+// anymore: it doesn't begin with a frame start, or a packet of it is missing
+// and reorderWindow packets or reorderTimeout passed since the packet after it
+func (a *frameAssembler) stalled(now time.Time) bool {
+	if len(a.packets) == 0 {
+		return false
+	}
+	if a.packets[a.next] != nil && !a.isStart(a.next) {
+		// the start of the frame went missing
+		return true
+	}
+
+	missing := a.next
+	for missing <= a.highest && a.packets[missing] != nil {
+		missing++
+	}
+	if missing > a.highest {
+		// nothing missing, the rest of the frame is on its way
+		return false
+	}
+	if a.highest-missing >= reorderWindow {
+		return true
+	}
+	after := missing + 1
+	for a.packets[after] == nil {
+		after++
+	}
+	return now.Sub(a.packets[after].arrived) > reorderTimeout
+}
+
+// skip drops the head of the buffer up to the next frame start
+func (a *frameAssembler) skip() {
+	dropped := a.next
+	droppedTimestamp, known := a.lastTimestamp, a.haveLast
+	if head := a.packets[a.next]; head != nil {
+		droppedTimestamp, known = head.packet.Timestamp, true
+	}
+
+	// the rest of the dropped frame can hold partition heads too, e.g. every
+	// NAL unit of an H.264 frame is one, the next frame has a new timestamp
+	next := a.highest + 1
+	for ext, p := range a.packets {
+		if ext > dropped && ext < next && a.isStart(ext) && (!known || p.packet.Timestamp != droppedTimestamp) {
+			next = ext
+		}
+	}
+	for ext := range a.packets {
+		if ext < next {
+			delete(a.packets, ext)
+		}
+	}
+	a.next = next
+	a.lastTimestamp, a.haveLast = droppedTimestamp, true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// vp9Frame packetizes a frame of n packets with a one byte non-flexible
+// descriptor, each packet's data is its index in the frame
+func vp9Frame(seq uint16, timestamp uint32, n int) []*rtp.Packet {
+	packets := make([]*rtp.Packet, n)
+	for i := range packets {
+		var desc byte
+		if i == 0 {
+			desc |= 0x08 // B
+		}
+		if i == n-1 {
+			desc |= 0x04 // E
+		}
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				SequenceNumber: seq + uint16(i),
+				Timestamp:      timestamp,
+				Marker:         i == n-1,
+			},
+			Payload: []byte{desc, byte(i)},
+		}
+	}
+	return packets
+}
+
+func TestFrameAssemblerLargeFrame(t *testing.T) {
+	a := newFrameAssembler(webrtc.MimeTypeVP9)
+	start := time.Now()
+	packets := vp9Frame(1000, 9000, 200)
+
+	for i, packet := range packets {
+		// slower than reorderTimeout from the first packet to the last
+		frames, lost := a.push(packet, start.Add(time.Duration(i)*time.Millisecond))
+		if lost {
+			t.Fatalf("packet %d: reported a loss in an in-order frame", i)
+		}
+		if i < len(packets)-1 && len(frames) > 0 {
+			t.Fatalf("packet %d: emitted a frame before its marker", i)
+		}
+		if i == len(packets)-1 {
+			if len(frames) != 1 {
+				t.Fatalf("got %d frames after the marker, want 1", len(frames))
+			}
+			if len(frames[0].data) != 200 || frames[0].timestamp != 9000 {
+				t.Fatalf("got frame of %d bytes at %d, want 200 bytes at 9000", len(frames[0].data), frames[0].timestamp)
+			}
+		}
+	}
+}
+
+// pushAll pushes packets at now and collects the emitted frames
+func pushAll(t *testing.T, a *frameAssembler, packets []*rtp.Packet, now time.Time) (frames []assembledFrame, lost bool) {
+	t.Helper()
+	for _, packet := range packets {
+		emitted, packetLost := a.push(packet, now)
+		frames = append(frames, emitted...)
+		lost = lost || packetLost
+	}
+	return frames, lost
+}
+
+func TestFrameAssemblerReordering(t *testing.T) {
+	a := newFrameAssembler(webrtc.MimeTypeVP9)
+	now := time.Now()
+	first := vp9Frame(100, 3000, 3)
+	second := vp9Frame(103, 6000, 2)
+
+	// the second frame arrives before the end of the first
+	packets := []*rtp.Packet{first[0], second[1], first[2], second[0]}
+	frames, lost := pushAll(t, a, packets, now)
+	if lost || len(frames) != 0 {
+		t.Fatalf("got %d frames, lost %t before the gap closed, want none", len(frames), lost)
+	}
+
+	frames, lost = pushAll(t, a, []*rtp.Packet{first[1]}, now)
+	if lost {
+		t.Fatal("reported a loss for reordered packets")
+	}
+	if len(frames) != 2 || frames[0].timestamp != 3000 || frames[1].timestamp != 6000 {
+		t.Fatalf("got %d frames, want the frames at 3000 and 6000 in order", len(frames))
+	}
+	if got := frames[0].data; len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Fatalf("got frame data %v, want packets in sequence order", got)
+	}
+}
+
+func TestFrameAssemblerSequenceWraparound(t *testing.T) {
+	a := newFrameAssembler(webrtc.MimeTypeVP9)
+	now := time.Now()
+
+	packets := append(vp9Frame(65533, 3000, 2), vp9Frame(65535, 6000, 3)...)
+	packets = append(packets, vp9Frame(2, 9000, 1)...)
+	frames, lost := pushAll(t, a, packets, now)
+	if lost {
+		t.Fatal("reported a loss across the wraparound")
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	if frames[1].timestamp != 6000 || len(frames[1].data) != 3 {
+		t.Fatalf("got frame of %d bytes at %d, want 3 bytes at 6000", len(frames[1].data), frames[1].timestamp)
+	}
+
+	// a retransmission from before the wraparound is late, not a new frame
+	if frames, lost := a.push(packets[0], now); len(frames) != 0 || lost {
+		t.Fatalf("late packet emitted %d frames, lost %t", len(frames), lost)
+	}
+}
+
+func TestFrameAssemblerLoss(t *testing.T) {
+	a := newFrameAssembler(webrtc.MimeTypeVP9)
+	now := time.Now()
+
+	if frames, _ := pushAll(t, a, vp9Frame(100, 3000, 3), now); len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+
+	// 104 never arrives
+	incomplete := vp9Frame(103, 6000, 3)
+	packets := []*rtp.Packet{incomplete[0], incomplete[2]}
+	packets = append(packets, vp9Frame(106, 9000, 2)...)
+	frames, lost := pushAll(t, a, packets, now)
+	if lost || len(frames) != 0 {
+		t.Fatalf("got %d frames, lost %t while waiting for the gap, want none", len(frames), lost)
+	}
+
+	frames, lost = pushAll(t, a, vp9Frame(108, 12000, 1), now.Add(2*reorderTimeout))
+	if !lost {
+		t.Fatal("dropping the incomplete frame wasn't reported as a loss")
+	}
+	if len(frames) != 2 || frames[0].timestamp != 9000 || frames[1].timestamp != 12000 {
+		t.Fatalf("got %d frames, want the frames at 9000 and 12000", len(frames))
+	}
+}
+
+func TestFrameAssemblerReorderWindow(t *testing.T) {
+	a := newFrameAssembler(webrtc.MimeTypeVP9)
+	now := time.Now()
+
+	if frames, _ := pushAll(t, a, vp9Frame(100, 3000, 1), now); len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+
+	// 102 never arrives and later frames pile up behind it, no time passes
+	frames, lost := pushAll(t, a, vp9Frame(101, 6000, 2)[:1], now)
+	for i := 0; i < reorderWindow; i++ {
+		emitted, packetLost := pushAll(t, a, vp9Frame(uint16(103+i), uint32(9000+i*3000), 1), now)
+		frames = append(frames, emitted...)
+		lost = lost || packetLost
+	}
+	if !lost {
+		t.Fatal("exceeding the reorder window wasn't reported as a loss")
+	}
+	if len(frames) != reorderWindow || frames[0].timestamp != 9000 {
+		t.Fatalf("got %d frames, want the %d frames after the gap", len(frames), reorderWindow)
+	}
+}
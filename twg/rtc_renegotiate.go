@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// mid-call renegotiation: tracks are added or removed on a live connection and
+// a new offer/answer is exchanged over /renegotiate. the answer comes back in
+// the http response, ICE transport and data channels are left untouched.
+
+// errRenegotiationBusy is returned when the peer is already in the middle of
+// another negotiation, the initiator may retry later
+var errRenegotiationBusy = errors.New("renegotiation already in progress")
+
+const renegotiateRetryDelay = 500 * time.Millisecond
+
+// Renegotiate adds and removes local tracks on the connection to peerIP and
+// redoes offer/answer without tearing the connection down
+func (rm *RTCManager) Renegotiate(peerIP string, addTrackIDs []uint8, removeTrackIDs []uint8) error {
+	rm.mu.RLock()
+	connection, exists := rm.connections[peerIP]
+	rm.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("[RTC] renegotiate: connection to %s not found", peerIP)
+	}
+
+	if !connection.negotiationMu.TryLock() {
+		return errRenegotiationBusy
+	}
+	defer connection.negotiationMu.Unlock()
+
+	if !connection.hasFeature(FEATURE_RENEGOTIATION) {
+		return fmt.Errorf("[RTC] renegotiate: %s does not support renegotiation", peerIP)
+	}
+
+	pc := connection.pc
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		return fmt.Errorf("[RTC] renegotiate: %s is in signaling state %s", peerIP, state)
+	}
+
+	connection.mu.Lock()
+	for _, trackID := range removeTrackIDs {
+		if err := rm.removeTrack(pc, connection, trackID); err != nil {
+			connection.mu.Unlock()
+			return err
+		}
+	}
+	for _, trackID := range addTrackIDs {
+		info, known := trackMap[trackID]
+		if !known {
+			connection.mu.Unlock()
+			return fmt.Errorf("[RTC] renegotiate: unknown track ID %d", trackID)
+		}
+		if _, exists := connection.senders[trackID]; exists {
+			continue
+		}
+		if err := rm.addTrack(pc, connection, trackID, info); err != nil {
+			connection.mu.Unlock()
+			return err
+		}
+	}
+	connection.mu.Unlock()
+
+	if err := rm.exchangeRenegotiation(connection, nil); err != nil {
+		return err
+	}
+
+	log.Printf("[RTC] Renegotiated with %s (added %v, removed %v)", peerIP, addTrackIDs, removeTrackIDs)
+	return nil
+}
+
+// exchangeRenegotiation creates a new offer with options and exchanges it over
+// /renegotiate, caller must hold connection.negotiationMu
+func (rm *RTCManager) exchangeRenegotiation(connection *RTCConnection, options *webrtc.OfferOptions) error {
+	pc := connection.pc
+	peerIP := connection.peerIP
+
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		return fmt.Errorf("[RTC] renegotiate: failed to create offer for %s: %v", peerIP, err)
+	}
+
+	// an ICE restart gathers new candidates, they go bundled in the sdp since
+	// the remote side can't use them before it has the new credentials
+	iceRestart := options != nil && options.ICERestart
+	var gatherComplete <-chan struct{}
+	if iceRestart {
+		connection.candidatesMu.Lock()
+		connection.localDescSent = false
+		connection.candidatesMu.Unlock()
+		gatherComplete = webrtc.GatheringCompletePromise(pc)
+	}
+
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("[RTC] renegotiate: failed to set local description for %s: %v", peerIP, err)
+	}
+
+	if iceRestart {
+		<-gatherComplete
+		offer = *pc.LocalDescription()
+
+		connection.candidatesMu.Lock()
+		connection.pendingCandidates = connection.pendingCandidates[:0]
+		connection.localDescSent = true
+		connection.candidatesMu.Unlock()
+	}
+
+	generation := connection.nextGeneration()
+	// back to stable so the next attempt can start over
+	rollback := func() {
+		if rbErr := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); rbErr != nil {
+			log.Printf("[RTC] renegotiate: rollback failed for %s: %v", peerIP, rbErr)
+		}
+	}
+
+	answer, err := rm.sendRenegotiateViaTS(connection, offer, generation)
+	if err != nil {
+		rollback()
+		connection.releaseGeneration(generation)
+		return err
+	}
+
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		// the peer already answered this generation, giving it back would make
+		// the next offer stale there
+		rollback()
+		return fmt.Errorf("[RTC] renegotiate: failed to set remote answer from %s: %v", peerIP, err)
+	}
+
+	return nil
+}
+
+// HandleRenegotiation answers a renegotiation offer, the returned payload
+// echoes its session and generation
+func (rm *RTCManager) HandleRenegotiation(offerData *HTTPpayload) (*HTTPpayload, error) {
+	peerIP := offerData.From
+	offer := offerData.SDPWithICE.SDP
+
+	rm.mu.RLock()
+	connection, exists := rm.connections[peerIP]
+	rm.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("[RTC] renegotiation from %s but connection not found", peerIP)
+	}
+
+	if connection.polite() {
+		// our own attempt, if any, is refused by the impolite side and rolled back
+		connection.negotiationMu.Lock()
+	} else if !connection.negotiationMu.TryLock() {
+		return nil, errRenegotiationBusy
+	}
+	defer connection.negotiationMu.Unlock()
+
+	pc := connection.pc
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return nil, errRenegotiationBusy
+	}
+
+	if err := connection.acceptRenegotiation(offerData); err != nil {
+		return nil, err
+	}
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return nil, fmt.Errorf("[RTC] Error setting renegotiation offer from %s: %v", peerIP, err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("[RTC] Failed to create renegotiation answer for %s: %v", peerIP, err)
+	}
+
+	// returns at once unless the offer was an ICE restart
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("[RTC] Failed to set renegotiation answer for %s: %v", peerIP, err)
+	}
+	<-gatherComplete
+
+	return &HTTPpayload{
+		From:       nodeInfo.TailscaleIP,
+		Role:       ANSWER,
+		SessionID:  offerData.SessionID,
+		Generation: offerData.Generation,
+		SDPWithICE: SDPWithICE{SDP: *pc.LocalDescription()},
+	}, nil
+}
+
+func (rm *RTCManager) sendRenegotiateViaTS(connection *RTCConnection, offer webrtc.SessionDescription, generation uint64) (webrtc.SessionDescription, error) {
+	targetIP := connection.peerIP
+	payload := HTTPpayload{
+		From:       nodeInfo.TailscaleIP,
+		Role:       OFFER,
+		SessionID:  connection.sessionID,
+		Generation: generation,
+		SDPWithICE: SDPWithICE{SDP: offer},
+	}
+
+	result, err := rm.postSignaling(targetIP, "renegotiate", payload)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	if result.Answer == nil {
+		// a retry found the offer already applied, but its answer is lost
+		return webrtc.SessionDescription{}, fmt.Errorf("[RTC] no renegotiation answer from %s: %w", targetIP, errStaleNegotiation)
+	}
+
+	answerData := result.Answer
+	if answerData.SessionID != "" && (answerData.SessionID != payload.SessionID || answerData.Generation != generation) {
+		return webrtc.SessionDescription{}, errStaleNegotiation
+	}
+
+	return answerData.SDPWithICE.SDP, nil
+}
+
+// renegotiatePeers runs Renegotiate for one peer, or every connected peer when
+// peerIP is empty, and reports each result to the frontend
+func (rm *RTCManager) renegotiatePeers(peerIP string, addTrackIDs []uint8, removeTrackIDs []uint8) {
+	var targets []string
+	if peerIP != "" {
+		targets = append(targets, peerIP)
+	} else {
+		rm.mu.RLock()
+		for ip, connection := range rm.connections {
+			if connection.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+				targets = append(targets, ip)
+			}
+		}
+		rm.mu.RUnlock()
+	}
+
+	for _, target := range targets {
+		err := rm.Renegotiate(target, addTrackIDs, removeTrackIDs)
+		if errors.Is(err, errRenegotiationBusy) {
+			// lost a glare or the peer was busy, one more try once it settles
+			time.Sleep(renegotiateRetryDelay)
+			err = rm.Renegotiate(target, addTrackIDs, removeTrackIDs)
+		}
+
+		result := struct {
+			Type   string `json:"type"`
+			Peer   string `json:"peerIP"`
+			Result string `json:"result"`
+			Error  string `json:"error,omitempty"`
+		}{
+			Type:   "renegotiation",
+			Peer:   target,
+			Result: "ok",
+		}
+		if err != nil {
+			log.Printf("[RTC] Renegotiation with %s failed: %v", target, err)
+			result.Result = "failed"
+			result.Error = err.Error()
+		}
+
+		jsonData, _ := json.Marshal(result)
+		sendMsgWs(jsonData)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// rooms: a peer in chat is in exactly one named room, peers without a room
+// (older builds) are in DEFAULT_ROOM. the RTCManager keeps a roster per room
+// from the peers' userState and roomJoin/roomLeave messages, and media only
+// goes to peers in the local room.
+
+const DEFAULT_ROOM = "default"
+
+func effectiveRoom(room string) string {
+	if room == "" {
+		return DEFAULT_ROOM
+	}
+	return room
+}
+
+type roomRoster struct {
+	rooms     map[string]map[string]bool // room ID to the set of peerIPs
+	peerRooms map[string]string          // peerIP to its room
+	since     map[string]int64           // peerIP to when it entered its room, 0 when unknown
+	mu        sync.Mutex
+}
+
+func newRoomRoster() roomRoster {
+	return roomRoster{
+		rooms:     make(map[string]map[string]bool),
+		peerRooms: make(map[string]string),
+		since:     make(map[string]int64),
+	}
+}
+
+// updateRoster puts peerIP in room, or takes it out of every room when it is not in chat
+func (rm *RTCManager) updateRoster(peerIP string, inChat bool, room string) {
+	rm.roster.mu.Lock()
+	defer rm.roster.mu.Unlock()
+
+	previous, wasIn := rm.roster.peerRooms[peerIP]
+	if inChat {
+		room = effectiveRoom(room)
+	}
+	if (wasIn && inChat && previous == room) || (!wasIn && !inChat) {
+		return
+	}
+
+	if wasIn {
+		delete(rm.roster.rooms[previous], peerIP)
+		delete(rm.roster.peerRooms, peerIP)
+		delete(rm.roster.since, peerIP)
+		if len(rm.roster.rooms[previous]) == 0 {
+			delete(rm.roster.rooms, previous)
+		}
+		rm.sendRosterLocked(previous)
+	}
+	if inChat {
+		if rm.roster.rooms[room] == nil {
+			rm.roster.rooms[room] = make(map[string]bool)
+		}
+		rm.roster.rooms[room][peerIP] = true
+		rm.roster.peerRooms[peerIP] = room
+		rm.sendRosterLocked(room)
+	}
+}
+
+func (rm *RTCManager) removeFromRoster(peerIP string) {
+	rm.updateRoster(peerIP, false, "")
+}
+
+// noteRoomSince records when peerIP entered room, as sent by the peer
+func (rm *RTCManager) noteRoomSince(peerIP string, room string, since int64) {
+	rm.roster.mu.Lock()
+	defer rm.roster.mu.Unlock()
+
+	if current, in := rm.roster.peerRooms[peerIP]; in && current == effectiveRoom(room) && since > 0 {
+		rm.roster.since[peerIP] = since
+	}
+}
+
+// sendRosterLocked tells the frontend who is in room, caller must hold rm.roster.mu
+func (rm *RTCManager) sendRosterLocked(room string) {
+	peers := make([]string, 0, len(rm.roster.rooms[room]))
+	for peerIP := range rm.roster.rooms[room] {
+		peers = append(peers, peerIP)
+	}
+	sort.Strings(peers)
+
+	rosterMsg := struct {
+		Type  string   `json:"type"`
+		Room  string   `json:"room"`
+		Peers []string `json:"peers"`
+	}{
+		Type:  "roomRoster",
+		Room:  room,
+		Peers: peers,
+	}
+	if jsonData, err := json.Marshal(rosterMsg); err == nil {
+		go sendMsgWs(jsonData)
+	}
+}
+
+// localRoom is the room media is sent to
+func localRoom() string {
+	mirrorStateMu.RLock()
+	defer mirrorStateMu.RUnlock()
+	return effectiveRoom(mirrorState.Room)
+}
+
+// setPeerRoom records a peer's chat state from its userState or room messages
+func (rm *RTCManager) setPeerRoom(peerIP string, inChat bool, room string) {
+	// held until the roster is updated, so a concurrent close can't be undone
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	connection, exists := rm.connections[peerIP]
+	if !exists {
+		return
+	}
+
+	connection.mu.Lock()
+	connection.isInChat = inChat
+	connection.room = room
+	connection.mu.Unlock()
+
+	rm.updateRoster(peerIP, inChat, room)
+}
+
+// joinRoom moves the local user into room, an empty room leaves chat. policy
+// makes the room private on this node, see rtc_rooms_private.go, joining
+// without one keeps the policy the room already has
+func (rm *RTCManager) joinRoom(room string, policy roomPolicy) {
+	if room != "" {
+		if policy.secret != "" || policy.capability != "" {
+			setRoomPolicy(room, policy)
+		}
+		rm.resetRoomAdmissions()
+	}
+
+	mirrorStateMu.Lock()
+	previous := mirrorState.Room
+	mirrorState.IsInChat = room != ""
+	mirrorState.Room = room
+	if room == "" {
+		mirrorState.RoomSince = 0
+	} else if previous != room || mirrorState.RoomSince == 0 {
+		mirrorState.RoomSince = time.Now().UnixMilli()
+	}
+	newState := mirrorState
+	mirrorStateMu.Unlock()
+
+	msg := map[string]interface{}{"type": "roomJoin", "room": room, "since": newState.RoomSince}
+	if room == "" {
+		msg = map[string]interface{}{"type": "roomLeave", "room": previous}
+		log.Printf("[rooms] Leaving room %s", effectiveRoom(previous))
+	} else {
+		log.Printf("[rooms] Joining room %s", room)
+	}
+
+	if jsonData, err := json.Marshal(msg); err == nil {
+		rm.sendToAllPeers(jsonData)
+	}
+	if room != "" {
+		rm.sendRoomProofs()
+	}
+	go rm.broadcastUserState(newState)
+	triggerPresenceBurst()
+
+	rm.roster.mu.Lock()
+	rm.sendRosterLocked(effectiveRoom(room))
+	rm.roster.mu.Unlock()
+}
+
+func (rm *RTCManager) sendToAllPeers(jsonData []byte) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	for peerIP, connection := range rm.connections {
+		connection.mu.RLock()
+		dc := connection.dc
+		connection.mu.RUnlock()
+
+		if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if err := dc.SendText(string(jsonData)); err != nil {
+			log.Printf("[RTC dc] Failed to send to %s: %v", peerIP, err)
+		} else {
+			metricDataChannelMessages.inc("out")
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"tailscale.com/tailcfg"
+)
+
+// private rooms: joining with a secret and/or a tailscale capability makes the
+// room private on this node. every member proves itself to every other member
+// over the data channel with a roomProof, an HMAC of the secret bound to both
+// addresses and the session. media and room chat only go to peers whose proof
+// was accepted, rejected peers are reported to the frontend with roomRejected.
+
+type roomPolicy struct {
+	secret     string                 // shared secret, empty when not required
+	capability tailcfg.PeerCapability // capability the peer must hold, empty when not required
+}
+
+var (
+	roomPolicies   = make(map[string]roomPolicy) // key is room ID
+	roomPoliciesMu sync.RWMutex
+)
+
+// setRoomPolicy makes room private, an empty policy makes it public again
+func setRoomPolicy(room string, policy roomPolicy) {
+	roomPoliciesMu.Lock()
+	defer roomPoliciesMu.Unlock()
+
+	room = effectiveRoom(room)
+	if policy.secret == "" && policy.capability == "" {
+		delete(roomPolicies, room)
+		return
+	}
+	roomPolicies[room] = policy
+}
+
+func privateRoomPolicy(room string) (roomPolicy, bool) {
+	roomPoliciesMu.RLock()
+	defer roomPoliciesMu.RUnlock()
+	policy, private := roomPolicies[effectiveRoom(room)]
+	return policy, private
+}
+
+// roomAdmitsLocked reports whether media and room chat for room may go to
+// connection, caller must hold connection.mu
+func (rm *RTCManager) roomAdmitsLocked(connection *RTCConnection, room string) bool {
+	if rm.moderation.bars(room, connection.peerIP) {
+		return false
+	}
+	if _, private := privateRoomPolicy(room); !private {
+		return true
+	}
+	return connection.admittedRoom == effectiveRoom(room)
+}
+
+// roomProof binds the secret to the room, both ends and the session, so a
+// proof can't be replayed to another node or on a later connection
+func roomProof(secret, room, prover, verifier, sessionID string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("relayx-room-proof|" + room + "|" + prover + "|" + verifier + "|" + sessionID))
+	return mac.Sum(nil)
+}
+
+type roomProofMsg struct {
+	Type  string `json:"type"`
+	Room  string `json:"room"`
+	Proof []byte `json:"proof,omitempty"`
+	Reply bool   `json:"reply,omitempty"` // the receiver should answer with its own proof
+}
+
+// sendRoomProof proves membership of the local room to connection, when the room is private
+func (rm *RTCManager) sendRoomProof(connection *RTCConnection, reply bool) {
+	room := localRoom()
+	policy, private := privateRoomPolicy(room)
+	if !private {
+		return
+	}
+
+	connection.mu.RLock()
+	dc := connection.dc
+	peerIP := connection.peerIP
+	sessionID := connection.sessionID
+	connection.mu.RUnlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+
+	msg := roomProofMsg{Type: "roomProof", Room: room, Reply: reply}
+	if policy.secret != "" {
+		msg.Proof = roomProof(policy.secret, room, nodeInfo.TailscaleIP, peerIP, sessionID)
+	}
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if err := dc.SendText(string(jsonData)); err != nil {
+		log.Printf("[rooms] Failed to send room proof to %s: %v", peerIP, err)
+	} else {
+		metricDataChannelMessages.inc("out")
+	}
+}
+
+// sendRoomProofs proves membership to every peer, after joining a room
+func (rm *RTCManager) sendRoomProofs() {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	for _, connection := range rm.connections {
+		rm.sendRoomProof(connection, true)
+	}
+}
+
+// verifyRoomProof checks a roomProof from peerIP, the reason is empty when it is accepted
+func (rm *RTCManager) verifyRoomProof(connection *RTCConnection, msg roomProofMsg) string {
+	policy, private := privateRoomPolicy(msg.Room)
+	if !private {
+		return ""
+	}
+
+	connection.mu.RLock()
+	peerIP := connection.peerIP
+	sessionID := connection.sessionID
+	connection.mu.RUnlock()
+
+	if policy.secret != "" {
+		expected := roomProof(policy.secret, effectiveRoom(msg.Room), peerIP, nodeInfo.TailscaleIP, sessionID)
+		if !hmac.Equal(expected, msg.Proof) {
+			return "bad_secret"
+		}
+	}
+	if policy.capability != "" && !peerAccess(peerIP).hasCapability(policy.capability) {
+		return "missing_capability"
+	}
+	return ""
+}
+
+// handleRoomProof admits or rejects a peer for a private room
+func (rm *RTCManager) handleRoomProof(peerIP string, data []byte) {
+	var msg roomProofMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[rooms] Malformed room proof from %s: %v", peerIP, err)
+		return
+	}
+
+	rm.mu.RLock()
+	connection, exists := rm.connections[peerIP]
+	rm.mu.RUnlock()
+	if !exists {
+		return
+	}
+	if _, private := privateRoomPolicy(msg.Room); !private {
+		// not a room we protect, nothing to check
+		return
+	}
+
+	reason := rm.verifyRoomProof(connection, msg)
+	connection.mu.Lock()
+	if reason == "" {
+		connection.admittedRoom = effectiveRoom(msg.Room)
+	} else if connection.admittedRoom == effectiveRoom(msg.Room) {
+		connection.admittedRoom = ""
+	}
+	dc := connection.dc
+	connection.mu.Unlock()
+
+	if reason != "" {
+		log.Printf("[rooms] Rejected %s for room %s: %s", peerIP, msg.Room, reason)
+		reportRoomRejected(peerIP, msg.Room, reason)
+		if dc != nil && dc.ReadyState() == webrtc.DataChannelStateOpen {
+			rejected, _ := json.Marshal(map[string]string{"type": "roomProofRejected", "room": msg.Room})
+			if err := dc.SendText(string(rejected)); err == nil {
+				metricDataChannelMessages.inc("out")
+			}
+		}
+		return
+	}
+
+	log.Printf("[rooms] Admitted %s to room %s", peerIP, msg.Room)
+	if msg.Reply && effectiveRoom(msg.Room) == localRoom() {
+		rm.sendRoomProof(connection, false)
+	}
+}
+
+// reportRoomRejected tells the frontend a peer failed a private room check,
+// peerIP is the peer that rejected us when reason is rejected_by_peer
+func reportRoomRejected(peerIP string, room string, reason string) {
+	rejectedMsg := struct {
+		Type   string `json:"type"`
+		Peer   string `json:"peerIP"`
+		Room   string `json:"room"`
+		Reason string `json:"reason"`
+	}{
+		Type:   "roomRejected",
+		Peer:   peerIP,
+		Room:   effectiveRoom(room),
+		Reason: reason,
+	}
+	if jsonData, err := json.Marshal(rejectedMsg); err == nil {
+		go sendMsgWs(jsonData)
+	}
+}
+
+// resetRoomAdmissions forgets every accepted proof, peers prove themselves again
+// in reply to our proofs
+func (rm *RTCManager) resetRoomAdmissions() {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	for _, connection := range rm.connections {
+		connection.mu.Lock()
+		connection.admittedRoom = ""
+		connection.mu.Unlock()
+	}
+}
+
+// admitsPeer is roomAdmitsLocked for a peer looked up by address
+func (rm *RTCManager) admitsPeer(peerIP string, room string) bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	connection, exists := rm.connections[peerIP]
+	if !exists {
+		return false
+	}
+	connection.mu.RLock()
+	defer connection.mu.RUnlock()
+	return rm.roomAdmitsLocked(connection, room)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// negotiation sessions: the offer side picks a random session ID for every new
+// connection, and every offer/answer exchange within it carries a generation
+// number. stale or duplicate messages are rejected instead of being applied.
+//
+// glare on the initial offer (both sides offering at once, e.g. after a
+// restart with clock skew) is settled by the session IDs alone: the larger one
+// keeps offering, the other side drops its pending offer and answers. for
+// renegotiation inside a session the answer side of the connection is polite
+// and yields to the offer side.
+
+var (
+	errStaleNegotiation = errors.New("stale or duplicate negotiation")
+	errAlreadyApplied   = errors.New("negotiation already applied")
+	errGlareRejected    = errors.New("concurrent offer rejected, ours wins")
+)
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("[RTC] Failed to generate session ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// polite side yields when both ends renegotiate at once
+func (c *RTCConnection) polite() bool {
+	return c.role == ANSWER
+}
+
+// HandleOffer answers an incoming initial offer, if admitOfferLocked accepts it
+func (rm *RTCManager) HandleOffer(offer *HTTPpayload) error {
+	return rm.createConnection(ANSWER, offer.From, offer)
+}
+
+// admitOfferLocked decides whether an incoming initial offer is accepted. the
+// existing connection, if any, is replaced under the same lock, caller must
+// hold rm.mu
+func (rm *RTCManager) admitOfferLocked(offer *HTTPpayload) error {
+	peerIP := offer.From
+	existing, exists := rm.connections[peerIP]
+	if !exists || offer.SessionID == "" {
+		return nil
+	}
+
+	existing.mu.RLock()
+	sessionID := existing.sessionID
+	generation := existing.generation
+	existing.mu.RUnlock()
+
+	switch {
+	case sessionID == offer.SessionID && offer.Generation == generation && existing.role == ANSWER:
+		// the offer we answered, its answer was lost
+		return errAlreadyApplied
+
+	case sessionID == offer.SessionID && offer.Generation <= generation:
+		return errStaleNegotiation
+
+	case existing.role == OFFER && !existing.hasRemoteDescription():
+		// glare: both sides sent an initial offer
+		if sessionID > offer.SessionID {
+			log.Printf("[RTC] Glare with %s, keeping our offer %s over %s", peerIP, sessionID, offer.SessionID)
+			return errGlareRejected
+		}
+		log.Printf("[RTC] Glare with %s, dropping our offer %s for %s", peerIP, sessionID, offer.SessionID)
+	}
+	return nil
+}
+
+func (c *RTCConnection) hasRemoteDescription() bool {
+	c.candidatesMu.RLock()
+	defer c.candidatesMu.RUnlock()
+	return c.remoteDescSet
+}
+
+// checkAnswer verifies that answer belongs to the offer we have outstanding,
+// caller must hold c.mu
+func (c *RTCConnection) checkAnswer(answer *HTTPpayload) error {
+	if c.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		if answer.SessionID != "" && answer.SessionID == c.sessionID && answer.Generation == c.generation && c.hasRemoteDescription() {
+			return fmt.Errorf("[RTC] answer from %s: %w", c.peerIP, errAlreadyApplied)
+		}
+		return fmt.Errorf("[RTC] answer from %s: %w (no outstanding offer)", c.peerIP, errStaleNegotiation)
+	}
+	if answer.SessionID == "" {
+		// peer without session support
+		return nil
+	}
+	if answer.SessionID != c.sessionID || answer.Generation != c.generation {
+		return fmt.Errorf("[RTC] answer from %s for %s/%d, expecting %s/%d: %w",
+			c.peerIP, answer.SessionID, answer.Generation, c.sessionID, c.generation, errStaleNegotiation)
+	}
+	return nil
+}
+
+// acceptRenegotiation checks a renegotiation offer against the session and
+// moves the generation forward, caller must hold c.negotiationMu
+func (c *RTCConnection) acceptRenegotiation(offer *HTTPpayload) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if offer.SessionID == "" {
+		return nil
+	}
+	if offer.SessionID != c.sessionID || offer.Generation <= c.generation {
+		return errStaleNegotiation
+	}
+	c.generation = offer.Generation
+	return nil
+}
+
+// nextGeneration reserves the generation for a new local offer
+func (c *RTCConnection) nextGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	return c.generation
+}
+
+// releaseGeneration gives back a generation reserved for an offer that was
+// rolled back, so the peer's offer for the same generation isn't stale
+func (c *RTCConnection) releaseGeneration(generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation == generation {
+		c.generation--
+	}
+}
+
+// takeEarlyCandidates removes the buffered candidates for peerIP and returns
+// those belonging to sessionID, caller must hold rm.mu
+func (rm *RTCManager) takeEarlyCandidates(peerIP string, sessionID string) []webrtc.ICECandidateInit {
+	var candidates []webrtc.ICECandidateInit
+	for _, payload := range rm.earlyCandidates[peerIP] {
+		if payload.SessionID == "" || payload.SessionID == sessionID {
+			candidates = append(candidates, payload.Candidate)
+		}
+	}
+	delete(rm.earlyCandidates, peerIP)
+	return candidates
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// every signaling endpoint answers with a SignalingResult, and requests are
+// sent through postSignaling which retries transport errors and 5xx with
+// backoff. definitive rejections are not retried and are reported to the
+// frontend, like the final failure after all retries.
+
+type SignalingStatus string
+
+const (
+	SIGNALING_ACCEPTED           SignalingStatus = "accepted"
+	SIGNALING_ALREADY_APPLIED    SignalingStatus = "already-applied"    // a retry of a message that got through
+	SIGNALING_REJECTED_DUPLICATE SignalingStatus = "rejected-duplicate" // stale, or a duplicate that wasn't applied
+	SIGNALING_REJECTED_GLARE     SignalingStatus = "rejected-glare"     // our own offer wins
+	SIGNALING_REJECTED_BUSY      SignalingStatus = "rejected-busy"      // another negotiation is running
+	SIGNALING_UNAUTHORIZED       SignalingStatus = "unauthorized"
+	SIGNALING_BAD_REQUEST        SignalingStatus = "bad-request"
+	SIGNALING_INTERNAL_ERROR     SignalingStatus = "internal-error"
+)
+
+type SignalingResult struct {
+	Status SignalingStatus `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Answer *HTTPpayload    `json:"answer,omitempty"` // /renegotiate only
+}
+
+var (
+	signalingAttempts     = 3
+	signalingRetryBackoff = 500 * time.Millisecond // doubled after each failed attempt
+)
+
+// err turns a rejection back into the sentinel error the handler returned
+func (r *SignalingResult) err() error {
+	switch r.Status {
+	case SIGNALING_ACCEPTED:
+		return nil
+	case SIGNALING_ALREADY_APPLIED:
+		return errAlreadyApplied
+	case SIGNALING_REJECTED_DUPLICATE:
+		return errStaleNegotiation
+	case SIGNALING_REJECTED_GLARE:
+		return errGlareRejected
+	case SIGNALING_REJECTED_BUSY:
+		return errRenegotiationBusy
+	default:
+		return fmt.Errorf("%s: %s", r.Status, r.Error)
+	}
+}
+
+func writeSignalingResult(w http.ResponseWriter, httpStatus int, result SignalingResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeSignalingAccepted(w http.ResponseWriter) {
+	writeSignalingResult(w, http.StatusOK, SignalingResult{Status: SIGNALING_ACCEPTED})
+}
+
+// writeSignalingError answers with the status matching err
+func writeSignalingError(w http.ResponseWriter, err error) {
+	httpStatus := http.StatusInternalServerError
+	status := SIGNALING_INTERNAL_ERROR
+	switch {
+	case errors.Is(err, errAlreadyApplied):
+		httpStatus, status = http.StatusOK, SIGNALING_ALREADY_APPLIED
+	case errors.Is(err, errStaleNegotiation):
+		httpStatus, status = http.StatusConflict, SIGNALING_REJECTED_DUPLICATE
+	case errors.Is(err, errGlareRejected):
+		httpStatus, status = http.StatusConflict, SIGNALING_REJECTED_GLARE
+	case errors.Is(err, errRenegotiationBusy):
+		httpStatus, status = http.StatusConflict, SIGNALING_REJECTED_BUSY
+	}
+	writeSignalingResult(w, httpStatus, SignalingResult{Status: status, Error: err.Error()})
+}
+
+// postSignaling sends payload to endpoint on targetIP and returns the peer's
+// result. each attempt falls back across the peer's addresses until one
+// answers. an already-applied answer to a retry means an earlier attempt got
+// through and only its response was lost, it is returned without error. a
+// duplicate rejection isn't, the peer may have dropped the message.
+func (rm *RTCManager) postSignaling(targetIP string, endpoint string, payload any) (*SignalingResult, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("[RTC] Failed to marshal JSON: %v", err)
+	}
+
+	backoff := signalingRetryBackoff
+	var result *SignalingResult
+	for attempt := 1; attempt <= signalingAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+		for _, addr := range peerAddrs(targetIP) {
+			url := fmt.Sprintf("http://%s/%s", net.JoinHostPort(addr, tcpPort), endpoint)
+			result, retry, err = rm.postSignalingOnce(url, jsonData)
+			if result != nil {
+				// the peer answered on this address
+				break
+			}
+		}
+		if err == nil {
+			return result, nil
+		}
+		if result != nil && result.Status == SIGNALING_ALREADY_APPLIED {
+			return result, nil
+		}
+		if !retry {
+			break
+		}
+		log.Printf("[RTC] /%s to %s failed (attempt %d/%d): %v", endpoint, targetIP, attempt, signalingAttempts, err)
+	}
+
+	// glare and busy rejections are part of normal negotiation
+	if !errors.Is(err, errGlareRejected) && !errors.Is(err, errRenegotiationBusy) {
+		reportSignalingFailure(targetIP, endpoint, result, err)
+	}
+	return result, err
+}
+
+// postSignalingOnce does a single request, retry tells whether it is worth another try
+func (rm *RTCManager) postSignalingOnce(url string, jsonData []byte) (result *SignalingResult, retry bool, err error) {
+	resp, err := rm.client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+
+	result = &SignalingResult{}
+	if jsonErr := json.Unmarshal(body, result); jsonErr != nil || result.Status == "" {
+		// builds without structured results answer 200 with an empty body
+		result = &SignalingResult{Status: SIGNALING_INTERNAL_ERROR, Error: resp.Status}
+		if resp.StatusCode == http.StatusOK {
+			result.Status = SIGNALING_ACCEPTED
+		}
+	}
+
+	if err := result.err(); err != nil {
+		return result, resp.StatusCode >= http.StatusInternalServerError, err
+	}
+	return result, false, nil
+}
+
+func reportSignalingFailure(targetIP string, endpoint string, result *SignalingResult, err error) {
+	failure := struct {
+		Type     string          `json:"type"`
+		Peer     string          `json:"peerIP"`
+		Endpoint string          `json:"endpoint"`
+		Status   SignalingStatus `json:"status,omitempty"`
+		Error    string          `json:"error"`
+	}{
+		Type:     "signalingError",
+		Peer:     targetIP,
+		Endpoint: endpoint,
+		Error:    err.Error(),
+	}
+	if result != nil {
+		failure.Status = result.Status
+	}
+
+	jsonData, _ := json.Marshal(failure)
+	sendMsgWs(jsonData)
+}
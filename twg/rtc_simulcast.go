@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// simulcast: the frontend encodes each video track several times, layer i at
+// about layerBitrates(trackID)[i], and tags every chunk with its layer. each
+// connection gets the highest layer its bitrate allocation allows. a
+// connection only moves to another layer on one of that layer's keyframes, so
+// the peer's decoder never sees a frame it has no reference for.
+
+const CHUNK_FLAG_KEYFRAME uint8 = 1 << 0
+
+// layerBitrates is the bitrate of each simulcast layer of a video track
+func layerBitrates(trackID uint8) []uint32 {
+	if trackID == CAMERA_VIDEO {
+		return cameraBitrateList
+	}
+	return videoBitrateList
+}
+
+// a layer counts as sent while it had a chunk within simulcastLayerTimeout
+var simulcastLayerTimeout = 2 * time.Second
+
+// simulcastLayers remembers when the frontend last sent each layer per track,
+// so a peer isn't waiting for a layer that doesn't exist
+var simulcastLayers = struct {
+	lastSeen map[uint8][]time.Time // key is track.ID, index is the layer
+	mu       sync.Mutex
+}{lastSeen: make(map[uint8][]time.Time)}
+
+// noteSimulcastLayer records a chunk of layer and returns the highest layer being sent
+func noteSimulcastLayer(trackID uint8, layer int) int {
+	simulcastLayers.mu.Lock()
+	defer simulcastLayers.mu.Unlock()
+
+	now := time.Now()
+	lastSeen := simulcastLayers.lastSeen[trackID]
+	for len(lastSeen) <= layer {
+		lastSeen = append(lastSeen, time.Time{})
+	}
+	lastSeen[layer] = now
+	simulcastLayers.lastSeen[trackID] = lastSeen
+
+	highest := layer
+	for i := len(lastSeen) - 1; i > layer; i-- {
+		if now.Sub(lastSeen[i]) < simulcastLayerTimeout {
+			highest = i
+			break
+		}
+	}
+	return highest
+}
+
+// wantedLayer is the highest layer within the connection's allocation for trackID,
+// caller must hold connection.mu
+func wantedLayer(connection *RTCConnection, trackID uint8, highest int) int {
+	target := connection.targetBitrates[trackID]
+	layer := 0
+	for i, bitrate := range layerBitrates(trackID) {
+		if bitrate <= target {
+			layer = i
+		}
+	}
+	return min(layer, highest)
+}
+
+// forwardLayer decides whether a chunk of layer goes to the connection,
+// switching layers on keyframes and asking the frontend for one while the
+// connection waits, caller must hold connection.mu
+func forwardLayer(connection *RTCConnection, trackID uint8, layer int, keyframe bool, highest int) bool {
+	want := wantedLayer(connection, trackID, highest)
+
+	connection.simulcastMu.Lock()
+	defer connection.simulcastMu.Unlock()
+
+	current, started := connection.videoLayers[trackID]
+	if layer == want && keyframe && (!started || current != want) {
+		connection.videoLayers[trackID] = want
+		return true
+	}
+	if !started {
+		requestKeyframe(trackID, videoCodecLocked(connection, trackID), want, connection.peerIP, "join")
+	} else if current != want {
+		requestKeyframe(trackID, videoCodecLocked(connection, trackID), want, connection.peerIP, "layer")
+	}
+	return started && layer == current
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type layerStep struct {
+	name     string
+	layer    int
+	keyframe bool
+	highest  int
+	want     bool
+}
+
+func TestForwardLayer(t *testing.T) {
+	const peerIP = "100.64.0.9"
+	connection := &RTCConnection{
+		peerIP:         peerIP,
+		targetBitrates: map[uint8]uint32{CAMERA_VIDEO: cameraBitrateList[1]},
+		videoLayers:    make(map[uint8]int),
+	}
+	codec := videoCodecLocked(connection, CAMERA_VIDEO)
+
+	// a request just went out for every layer, so new ones stay pending
+	interval := keyframeRequestInterval
+	keyframeRequestInterval = time.Hour
+	keyframeRequests.mu.Lock()
+	for layer := range cameraBitrateList {
+		keyframeRequests.lastSent[keyframeKey{trackID: CAMERA_VIDEO, codec: codec, layer: layer}] = time.Now()
+	}
+	keyframeRequests.mu.Unlock()
+	t.Cleanup(func() {
+		keyframeRequestInterval = interval
+		keyframeRequests.mu.Lock()
+		clear(keyframeRequests.pending)
+		clear(keyframeRequests.lastSent)
+		keyframeRequests.mu.Unlock()
+	})
+
+	requested := func(layer int) bool {
+		keyframeRequests.mu.Lock()
+		defer keyframeRequests.mu.Unlock()
+		request, exists := keyframeRequests.pending[keyframeKey{trackID: CAMERA_VIDEO, codec: codec, layer: layer}]
+		return exists && len(request.peers) == 1 && request.peers[0] == peerIP
+	}
+	run := func(steps []layerStep) {
+		t.Helper()
+		for _, step := range steps {
+			if got := forwardLayer(connection, CAMERA_VIDEO, step.layer, step.keyframe, step.highest); got != step.want {
+				t.Fatalf("%s: forwardLayer(layer %d, keyframe %t) = %t, want %t", step.name, step.layer, step.keyframe, got, step.want)
+			}
+		}
+	}
+
+	run([]layerStep{
+		{"waits for a keyframe", 1, false, 2, false},
+		{"not the wanted layer", 0, true, 2, false},
+		{"starts on the keyframe", 1, true, 2, true},
+		{"stays on the layer", 1, false, 2, true},
+		{"other layers", 0, false, 2, false},
+	})
+	if !requested(1) {
+		t.Fatal("no keyframe request for layer 1 while joining")
+	}
+
+	// the allocation grows, the old layer goes on until the new one has a keyframe
+	connection.targetBitrates[CAMERA_VIDEO] = cameraBitrateList[2]
+	run([]layerStep{
+		{"old layer until the switch", 1, false, 2, true},
+		{"new layer without a keyframe", 2, false, 2, false},
+		{"switches on the keyframe", 2, true, 2, true},
+		{"old layer after the switch", 1, true, 2, false},
+		{"new layer", 2, false, 2, true},
+	})
+	if !requested(2) {
+		t.Fatal("no keyframe request for layer 2 while switching")
+	}
+
+	// the frontend stops sending layer 2, the connection falls back to layer 1
+	run([]layerStep{
+		{"old layer until the switch", 2, false, 1, true},
+		{"switches down on the keyframe", 1, true, 1, true},
+		{"stays down", 1, false, 1, true},
+	})
+	if connection.videoLayers[CAMERA_VIDEO] != 1 {
+		t.Fatalf("on layer %d, want 1", connection.videoLayers[CAMERA_VIDEO])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// connection supervisor: when a connection goes disconnected or failed, the
+// offer side tries ICE restarts with backoff, then rebuilds the connection from
+// scratch. the answer side only waits, and drops a connection that never comes
+// back so the next offer can replace it.
+
+var (
+	disconnectGrace   = 3 * time.Second // disconnected often recovers on its own
+	iceRestartTimeout = 5 * time.Second // time to reach connected after a restart
+	maxICERestarts    = 3
+	iceRestartBackoff = 1 * time.Second // doubled after each failed attempt
+	answerSideTimeout = 30 * time.Second
+)
+
+type recoveryEvent struct {
+	Type    string `json:"type"` // "connectionRecovery"
+	Peer    string `json:"peerIP"`
+	State   string `json:"state"` // restarting, restarted, rebuilding, rebuilt, closed
+	Attempt int    `json:"attempt,omitempty"`
+}
+
+func sendRecoveryEvent(peerIP string, state string, attempt int) {
+	jsonData, err := json.Marshal(recoveryEvent{
+		Type:    "connectionRecovery",
+		Peer:    peerIP,
+		State:   state,
+		Attempt: attempt,
+	})
+	if err != nil {
+		log.Printf("[RTC supervisor] Failed to marshal recovery event: %v", err)
+		return
+	}
+	sendMsgWs(jsonData)
+}
+
+// onConnectionState is called from OnConnectionStateChange and starts one
+// supervisor per connection
+func (rm *RTCManager) onConnectionState(connection *RTCConnection, state webrtc.PeerConnectionState) {
+	if state != webrtc.PeerConnectionStateDisconnected && state != webrtc.PeerConnectionStateFailed {
+		return
+	}
+
+	connection.mu.Lock()
+	if connection.supervising {
+		connection.mu.Unlock()
+		return
+	}
+	connection.supervising = true
+	connection.mu.Unlock()
+
+	go rm.superviseConnection(connection)
+}
+
+// isCurrent reports whether connection is still the one stored for its peer
+func (rm *RTCManager) isCurrent(connection *RTCConnection) bool {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.connections[connection.peerIP] == connection
+}
+
+// waitConnected polls the connection state until connected or timeout
+func waitConnected(pc *webrtc.PeerConnection, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+}
+
+func (rm *RTCManager) superviseConnection(connection *RTCConnection) {
+	peerIP := connection.peerIP
+	defer func() {
+		connection.mu.Lock()
+		connection.supervising = false
+		connection.mu.Unlock()
+	}()
+
+	if connection.pc.ConnectionState() == webrtc.PeerConnectionStateDisconnected &&
+		waitConnected(connection.pc, disconnectGrace) {
+		return
+	}
+
+	if connection.role != OFFER {
+		// the offer side drives recovery, give it time before dropping ours
+		if waitConnected(connection.pc, answerSideTimeout) || !rm.isCurrent(connection) {
+			return
+		}
+		log.Printf("[RTC supervisor] Connection to %s did not recover, closing", peerIP)
+		rm.mu.Lock()
+		if rm.connections[peerIP] == connection {
+			rm.closeConnection(peerIP, connection)
+		}
+		rm.mu.Unlock()
+		sendRecoveryEvent(peerIP, "closed", 0)
+		return
+	}
+
+	restarts := maxICERestarts
+	if !connection.hasFeature(FEATURE_ICE_RESTART) {
+		// older peers can only be rebuilt
+		restarts = 0
+	}
+
+	backoff := iceRestartBackoff
+	for attempt := 1; attempt <= restarts; attempt++ {
+		if !rm.isCurrent(connection) {
+			return
+		}
+
+		sendRecoveryEvent(peerIP, "restarting", attempt)
+		log.Printf("[RTC supervisor] ICE restart %d/%d for %s", attempt, restarts, peerIP)
+
+		if err := rm.restartICE(connection); err != nil {
+			log.Printf("[RTC supervisor] ICE restart for %s failed: %v", peerIP, err)
+		} else if waitConnected(connection.pc, iceRestartTimeout) {
+			sendRecoveryEvent(peerIP, "restarted", attempt)
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if !rm.isCurrent(connection) {
+		return
+	}
+
+	sendRecoveryEvent(peerIP, "rebuilding", 0)
+	log.Printf("[RTC supervisor] Rebuilding connection to %s", peerIP)
+
+	connection.mu.RLock()
+	isInChat := connection.isInChat
+	room := connection.room
+	connection.mu.RUnlock()
+
+	rm.mu.Lock()
+	if rm.connections[peerIP] == connection {
+		rm.closeConnection(peerIP, connection)
+	}
+	rm.mu.Unlock()
+
+	if err := rm.createConnectionWithState(OFFER, peerIP, nil, isInChat, room); err != nil {
+		log.Printf("[RTC supervisor] Rebuilding connection to %s failed: %v", peerIP, err)
+		sendRecoveryEvent(peerIP, "closed", 0)
+		return
+	}
+	sendRecoveryEvent(peerIP, "rebuilt", 0)
+}
+
+func (rm *RTCManager) restartICE(connection *RTCConnection) error {
+	if !connection.negotiationMu.TryLock() {
+		return errRenegotiationBusy
+	}
+	defer connection.negotiationMu.Unlock()
+
+	return rm.exchangeRenegotiation(connection, &webrtc.OfferOptions{ICERestart: true})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// VP9 temporal layers: simulcast picks the resolution a peer gets, see
+// rtc_simulcast.go. where the encoder can, the frontend encodes each VP9
+// simulcast layer with temporal layers (L1T3) and tags each chunk with its
+// temporal ID. the gateway packetizes it in flexible mode with the layer
+// indices in the payload descriptor and measures the bitrate of each temporal
+// layer. a connection gets every temporal layer of its simulcast layer while
+// the measured rates fit its allocation and drops the top ones while they
+// don't, so the allocation only picks the simulcast layer and thins what it
+// actually costs. the screen share track is a TrackLocalStaticRTP so each peer
+// gets its own gapless sequence numbers. chunks without SVC, and H.264 and AV1
+// chunks, are packetized by the pion payloaders.
+
+const CHUNK_FLAG_SVC uint8 = 1 << 1 // bits 2-4 carry the temporal ID, bits 5-7 the spatial ID
+
+const (
+	svcTemporalShift = 2
+	svcSpatialShift  = 5
+	svcLayerMask     = 0x07
+	maxSVCLayers     = 8
+
+	vp9MTU           = 1200
+	vp9ClockRate     = 90000
+	vp9PictureIDMask = 0x7FFF
+	maxVP9PDiff      = 0x7F
+
+	noPicture int32 = -1
+
+	temporalRateWindow = time.Second // temporal layer bitrates are measured over this
+)
+
+type svcInfo struct {
+	enabled bool
+	tid     uint8
+	sid     uint8
+}
+
+func chunkSVC(flags uint8) svcInfo {
+	return svcInfo{
+		enabled: flags&CHUNK_FLAG_SVC != 0,
+		tid:     flags >> svcTemporalShift & svcLayerMask,
+		sid:     flags >> svcSpatialShift & svcLayerMask,
+	}
+}
+
+// screenPacket is a packetized screen share frame, with its parsed descriptor
+type screenPacket struct {
+	payload   []byte
+	timestamp uint32
+	endOfPic  bool // last packet of the top spatial layer of the picture
+	desc      codecs.VP9Packet
+}
+
+type screenPacketizer struct {
+	payloader   rtp.Payloader // chunks without SVC
+	pictureID   uint16
+	started     bool
+	lastPicture [maxSVCLayers][maxSVCLayers]int32 // [sid][tid] last picture ID, noPicture when none
+	maxSID      uint8
+	broken      bool // a frame had no reference, frames are dropped until a keyframe
+
+	tidBytes    [maxSVCLayers]uint64 // bytes per temporal layer since windowStart
+	windowStart time.Time
+	tidRates    [maxSVCLayers]uint32 // bps per temporal layer over the last window
+}
+
+func newScreenPacketizer(codec uint8) *screenPacketizer {
+	p := &screenPacketizer{payloader: &codecs.VP9Payloader{}}
+	switch codec {
+	case CODEC_H264:
+		p.payloader = &codecs.H264Payloader{}
+	case CODEC_AV1:
+		p.payloader = &codecs.AV1Payloader{}
+	}
+	p.resetRefs()
+	return p
+}
+
+func (p *screenPacketizer) resetRefs() {
+	for sid := range p.lastPicture {
+		for tid := range p.lastPicture[sid] {
+			p.lastPicture[sid][tid] = noPicture
+		}
+	}
+}
+
+type packetizerKey struct {
+	codec uint8
+	layer int
+}
+
+// one packetizer per codec and simulcast layer, each is its own stream
+var screenPacketizers = struct {
+	byLayer map[packetizerKey]*screenPacketizer
+	mu      sync.Mutex
+}{byLayer: make(map[packetizerKey]*screenPacketizer)}
+
+// packetizeScreenShare turns a screen share chunk into RTP payloads, with
+// parsed descriptors for VP9. timestamp comes from the capture timestamp, so
+// every spatial layer of a picture shares it
+func packetizeScreenShare(codec uint8, layer int, svc svcInfo, keyframe bool, timestamp uint32, frame []byte) []screenPacket {
+	screenPacketizers.mu.Lock()
+	defer screenPacketizers.mu.Unlock()
+
+	key := packetizerKey{codec: codec, layer: layer}
+	p, exists := screenPacketizers.byLayer[key]
+	if !exists {
+		p = newScreenPacketizer(codec)
+		screenPacketizers.byLayer[key] = p
+	}
+	if codec != CODEC_VP9 {
+		svc.enabled = false
+	}
+
+	var payloads [][]byte
+	if svc.enabled {
+		payloads = p.payloadSVC(svc, keyframe, frame)
+		p.measure(svc.tid, len(frame), time.Now())
+	} else {
+		payloads = p.payloader.Payload(vp9MTU, frame)
+	}
+
+	packets := make([]screenPacket, 0, len(payloads))
+	for i, payload := range payloads {
+		packet := screenPacket{payload: payload, timestamp: timestamp}
+		if codec != CODEC_VP9 {
+			packet.endOfPic = i == len(payloads)-1
+			packets = append(packets, packet)
+			continue
+		}
+		if _, err := packet.desc.Unmarshal(payload); err != nil {
+			log.Printf("[svc] Failed to parse VP9 descriptor: %v", err)
+			return nil
+		}
+		packet.endOfPic = i == len(payloads)-1 && (!svc.enabled || svc.sid >= p.maxSID)
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// measure adds a frame of temporal layer tid to the bitrate window
+func (p *screenPacketizer) measure(tid uint8, size int, now time.Time) {
+	if p.windowStart.IsZero() {
+		p.windowStart = now
+	}
+	p.tidBytes[tid] += uint64(size)
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < temporalRateWindow {
+		return
+	}
+	for i, bytes := range p.tidBytes {
+		p.tidRates[i] = uint32(bytes * 8 * uint64(time.Second) / uint64(elapsed))
+		p.tidBytes[i] = 0
+	}
+	p.windowStart = now
+}
+
+// temporalRates is the measured bitrate of each temporal layer of a codec's
+// simulcast layer, all 0 until a window passed
+func temporalRates(codec uint8, layer int) [maxSVCLayers]uint32 {
+	screenPacketizers.mu.Lock()
+	defer screenPacketizers.mu.Unlock()
+
+	if p, exists := screenPacketizers.byLayer[packetizerKey{codec: codec, layer: layer}]; exists {
+		return p.tidRates
+	}
+	return [maxSVCLayers]uint32{}
+}
+
+// payloadSVC packetizes one layer frame in flexible mode. a frame references
+// the most recent picture of any lower temporal layer in its spatial layer, or
+// the latest base layer picture when it is on the base layer, which is the
+// reference structure of the L1T2/L1T3 modes WebCodecs produces. a non-keyframe
+// without a reference in reach is dropped, and so is everything after it
+// until the next keyframe, returning nil.
+func (p *screenPacketizer) payloadSVC(svc svcInfo, keyframe bool, frame []byte) [][]byte {
+	if svc.sid == 0 {
+		if p.started {
+			p.pictureID = (p.pictureID + 1) & vp9PictureIDMask
+		}
+		p.started = true
+	}
+	if keyframe && svc.sid == 0 {
+		p.resetRefs()
+		p.maxSID = 0
+	}
+	p.maxSID = max(p.maxSID, svc.sid)
+
+	if keyframe && svc.sid == 0 {
+		p.broken = false
+	}
+
+	var pDiff uint16
+	predicted := !keyframe
+	if predicted {
+		for tid := range max(svc.tid, 1) {
+			ref := p.lastPicture[svc.sid][tid]
+			if ref == noPicture {
+				continue
+			}
+			diff := (p.pictureID - uint16(ref)) & vp9PictureIDMask
+			if diff > 0 && (pDiff == 0 || diff < pDiff) {
+				pDiff = diff
+			}
+		}
+		if pDiff == 0 || pDiff > maxVP9PDiff {
+			// the reference was never sent or is out of reach, a decoder
+			// can't use this frame or anything predicted from it
+			p.broken = true
+		}
+	}
+	if p.broken {
+		return nil
+	}
+	p.lastPicture[svc.sid][svc.tid] = int32(p.pictureID)
+
+	headerSize := 4
+	if predicted {
+		headerSize++
+	}
+	var payloads [][]byte
+	for offset := 0; offset < len(frame); {
+		size := min(vp9MTU-headerSize, len(frame)-offset)
+		out := make([]byte, headerSize+size)
+
+		out[0] = 0x80 | 0x20 | 0x10 // I=1, L=1, F=1
+		if predicted {
+			out[0] |= 0x40 // P=1
+		}
+		if offset == 0 {
+			out[0] |= 0x08 // B=1
+		}
+		if offset+size == len(frame) {
+			out[0] |= 0x04 // E=1
+		}
+		out[1] = byte(p.pictureID>>8) | 0x80
+		out[2] = byte(p.pictureID)
+
+		// TID, U, SID, D. every frame only references lower temporal layers, so
+		// all of them are switching up points
+		out[3] = svc.tid<<5 | 1<<4 | svc.sid<<1
+		if svc.sid > 0 {
+			out[3] |= 0x01 // D=1
+		}
+		if predicted {
+			out[4] = byte(pDiff << 1) // N=0, a single reference
+		}
+
+		copy(out[headerSize:], frame[offset:offset+size])
+		payloads = append(payloads, out)
+		offset += size
+	}
+	return payloads
+}
+
+// temporalCutoff is the highest temporal layer that fits the connection's
+// screen share allocation by the measured rates, all of them until rates are
+// measured, caller must hold connection.mu
+func temporalCutoff(connection *RTCConnection, rates [maxSVCLayers]uint32) uint8 {
+	target := connection.targetBitrates[SCREEN_SHARE_VIDEO]
+	var total uint32
+	for tid, rate := range rates {
+		total += rate
+		if tid > 0 && total > target {
+			return uint8(tid - 1)
+		}
+	}
+	return maxSVCLayers - 1
+}
+
+// writeScreenPackets sends the temporal layers of a packetized frame the
+// connection can carry, caller must hold connection.mu
+func writeScreenPackets(connection *RTCConnection, packets []screenPacket, rates [maxSVCLayers]uint32) {
+	track := connection.videoRTCtrack
+	cutoff := temporalCutoff(connection, rates)
+
+	connection.simulcastMu.Lock()
+	defer connection.simulcastMu.Unlock()
+
+	for _, packet := range packets {
+		if packet.desc.L && packet.desc.TID > cutoff {
+			// every packet of a picture has the same TID
+			metricDroppedFrames.inc("svc_layer")
+			return
+		}
+
+		connection.svcSeq++
+		err := track.WriteRTP(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         packet.endOfPic,
+				SequenceNumber: connection.svcSeq,
+				Timestamp:      packet.timestamp,
+			},
+			Payload: packet.payload,
+		})
+		if err != nil {
+			metricDroppedFrames.inc("write_failed")
+			return
+		}
+	}
+}
+
+// newScreenShareTrack is the RTP track screen share packets are written to, in mimeType
+func newScreenShareTrack(t trackInfo, mimeType string) (*webrtc.TrackLocalStaticRTP, error) {
+	return webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: vp9ClockRate},
+		t.id,
+		t.streamID,
+	)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp/codecs"
+)
+
+// parseSVC parses the descriptors of payloadSVC's output
+func parseSVC(t *testing.T, payloads [][]byte) []codecs.VP9Packet {
+	t.Helper()
+	descs := make([]codecs.VP9Packet, len(payloads))
+	for i, payload := range payloads {
+		if _, err := descs[i].Unmarshal(payload); err != nil {
+			t.Fatalf("payload %d: %v", i, err)
+		}
+	}
+	return descs
+}
+
+func TestPayloadSVCReferences(t *testing.T) {
+	p := newScreenPacketizer(CODEC_VP9)
+	frame := []byte{1, 2, 3}
+
+	// the L1T3 pattern: T0 T2 T1 T2 T0
+	pictures := []struct {
+		tid      uint8
+		keyframe bool
+		pDiff    uint8 // 0 for a keyframe
+	}{
+		{0, true, 0},
+		{2, false, 1}, // the T0 keyframe
+		{1, false, 2}, // the T0 keyframe
+		{2, false, 1}, // the T1 picture
+		{0, false, 4}, // the T0 keyframe
+	}
+	for i, picture := range pictures {
+		descs := parseSVC(t, p.payloadSVC(svcInfo{enabled: true, tid: picture.tid}, picture.keyframe, frame))
+		if len(descs) != 1 {
+			t.Fatalf("picture %d: got %d payloads, want 1", i, len(descs))
+		}
+		desc := descs[0]
+		if desc.PictureID != uint16(i) || desc.TID != picture.tid || !desc.L || !desc.F {
+			t.Fatalf("picture %d: got picture ID %d TID %d L %t F %t", i, desc.PictureID, desc.TID, desc.L, desc.F)
+		}
+		if picture.keyframe {
+			if desc.P || len(desc.PDiff) != 0 {
+				t.Fatalf("picture %d: keyframe is predicted", i)
+			}
+			continue
+		}
+		if !desc.P || len(desc.PDiff) != 1 || desc.PDiff[0] != picture.pDiff {
+			t.Fatalf("picture %d: got P %t references %v, want %d", i, desc.P, desc.PDiff, picture.pDiff)
+		}
+	}
+}
+
+func TestPayloadSVCFragmentation(t *testing.T) {
+	p := newScreenPacketizer(CODEC_VP9)
+	frame := make([]byte, 3000)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+
+	payloads := p.payloadSVC(svcInfo{enabled: true}, true, frame)
+	descs := parseSVC(t, payloads)
+	if len(descs) != 3 {
+		t.Fatalf("got %d payloads, want 3", len(descs))
+	}
+	var joined []byte
+	for i, desc := range descs {
+		if len(payloads[i]) > vp9MTU {
+			t.Fatalf("payload %d is %d bytes, over the MTU", i, len(payloads[i]))
+		}
+		if desc.B != (i == 0) || desc.E != (i == len(descs)-1) {
+			t.Fatalf("payload %d: got B %t E %t", i, desc.B, desc.E)
+		}
+		joined = append(joined, desc.Payload...)
+	}
+	if string(joined) != string(frame) {
+		t.Fatal("the payloads don't add up to the frame")
+	}
+}
+
+func TestPayloadSVCBrokenUntilKeyframe(t *testing.T) {
+	p := newScreenPacketizer(CODEC_VP9)
+	frame := []byte{1}
+
+	if p.payloadSVC(svcInfo{enabled: true, tid: 1}, false, frame) != nil {
+		t.Fatal("sent a predicted frame before any keyframe")
+	}
+	if p.payloadSVC(svcInfo{enabled: true}, true, frame) == nil {
+		t.Fatal("dropped the keyframe")
+	}
+
+	// T2 pictures only reference the keyframe, it goes out of reach
+	for i := 1; i <= maxVP9PDiff; i++ {
+		if p.payloadSVC(svcInfo{enabled: true, tid: 2}, false, frame) == nil {
+			t.Fatalf("picture %d: dropped with the reference in reach", i)
+		}
+	}
+	if p.payloadSVC(svcInfo{enabled: true, tid: 2}, false, frame) != nil {
+		t.Fatal("sent a picture with its reference out of reach")
+	}
+	if p.payloadSVC(svcInfo{enabled: true, tid: 0}, false, frame) != nil {
+		t.Fatal("sent a picture after a dropped one before a keyframe")
+	}
+	if p.payloadSVC(svcInfo{enabled: true}, true, frame) == nil {
+		t.Fatal("dropped the keyframe that recovers the stream")
+	}
+}
+
+func TestPacketizeScreenShareEndOfPicture(t *testing.T) {
+	const layer = 2
+	key := packetizerKey{codec: CODEC_VP9, layer: layer}
+	screenPacketizers.mu.Lock()
+	delete(screenPacketizers.byLayer, key)
+	screenPacketizers.mu.Unlock()
+	t.Cleanup(func() {
+		screenPacketizers.mu.Lock()
+		delete(screenPacketizers.byLayer, key)
+		screenPacketizers.mu.Unlock()
+	})
+
+	frame := make([]byte, 2000)
+	chunks := []struct {
+		sid      uint8
+		keyframe bool
+		endOfPic bool
+	}{
+		{0, true, true}, // no spatial layer above it yet
+		{1, true, true},
+		{0, false, false}, // the S1 frame follows
+		{1, false, true},
+	}
+	for i, chunk := range chunks {
+		packets := packetizeScreenShare(CODEC_VP9, layer, svcInfo{enabled: true, sid: chunk.sid}, chunk.keyframe, 9000, frame)
+		if len(packets) != 2 {
+			t.Fatalf("chunk %d: got %d packets, want 2", i, len(packets))
+		}
+		if packets[0].endOfPic || packets[1].endOfPic != chunk.endOfPic {
+			t.Fatalf("chunk %d: got end of picture %t %t, want false %t", i, packets[0].endOfPic, packets[1].endOfPic, chunk.endOfPic)
+		}
+		if packets[1].desc.SID != chunk.sid || !packets[1].desc.L {
+			t.Fatalf("chunk %d: descriptor has SID %d", i, packets[1].desc.SID)
+		}
+	}
+}
+
+func TestTemporalCutoff(t *testing.T) {
+	rates := [maxSVCLayers]uint32{100000, 50000, 50000}
+	tests := []struct {
+		target uint32
+		rates  [maxSVCLayers]uint32
+		want   uint8
+	}{
+		{1000000, rates, maxSVCLayers - 1},
+		{160000, rates, 1},
+		{120000, rates, 0},
+		{50000, rates, 0},                             // the base layer always goes
+		{0, [maxSVCLayers]uint32{}, maxSVCLayers - 1}, // not measured yet
+	}
+	for _, tt := range tests {
+		connection := &RTCConnection{targetBitrates: map[uint8]uint32{SCREEN_SHARE_VIDEO: tt.target}}
+		if got := temporalCutoff(connection, tt.rates); got != tt.want {
+			t.Errorf("target %d: got cutoff %d, want %d", tt.target, got, tt.want)
+		}
+	}
+}
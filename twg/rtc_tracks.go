@@ -2,11 +2,12 @@ package main
 
 import (
 	"log"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pion/interceptor"
 	// "github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 )
@@ -15,6 +16,7 @@ const (
 	MICROPHONE_AUDIO   uint8 = 0
 	CPA_AUDIO          uint8 = 1
 	SCREEN_SHARE_VIDEO uint8 = 2
+	CAMERA_VIDEO       uint8 = 3
 )
 
 type trackInfo struct {
@@ -43,20 +45,24 @@ var trackMap = map[uint8]trackInfo{
 		id:       "screen-share-video",
 		streamID: "screen-share",
 	},
+	// VP8 for the camera, it is cheaper to encode and decode than VP9 for
+	// natural video and every browser has it in hardware. the codec is fixed:
+	// unlike the screen share it isn't negotiated per peer (rtc_codecs.go), the
+	// frontend's camera encoder only produces VP8 and every peer can decode it
+	CAMERA_VIDEO: {
+		Kind:     webrtc.RTPCodecTypeVideo,
+		MimeType: webrtc.MimeTypeVP8,
+		id:       "camera-video",
+		streamID: "camera",
+	},
 }
 
-// ipv4ToBytes 将 IPv4 字符串转换为 4 字节数组
-func ipv4ToBytes(ip string) [4]byte {
-	var result [4]byte
-	parts := strings.Split(ip, ".")
-	if len(parts) == 4 {
-		for i, part := range parts {
-			if val, err := strconv.Atoi(part); err == nil && val >= 0 && val <= 255 {
-				result[i] = byte(val)
-			}
-		}
-	}
-	return result
+// mediaHeader 构造发往前端的媒体包头: 1字节轨道ID + 1字节peer ID长度 + peer ID
+// (peer ID 即 onlinePeers 中的 key, IPv4 或 IPv6 地址)
+func mediaHeader(trackID uint8, peerIP string, payloadSize int) []byte {
+	packet := make([]byte, 0, 2+len(peerIP)+payloadSize)
+	packet = append(packet, trackID, byte(len(peerIP)))
+	return append(packet, peerIP...)
 }
 
 func (rm *RTCManager) addTracks(pc *webrtc.PeerConnection, connection *RTCConnection) error {
@@ -85,34 +91,96 @@ func (rm *RTCManager) addTracks(pc *webrtc.PeerConnection, connection *RTCConnec
 		// 	go handleRTCP("sender:"+track.ID(), sender)
 		// 	continue
 		// }
-		track, err := webrtc.NewTrackLocalStaticSample(
-			webrtc.RTPCodecCapability{MimeType: t.MimeType},
-			t.id,
-			t.streamID,
-		)
-		if err != nil {
-			log.Printf("[RTC] Failed to create track: %v", err)
+		if err := rm.addTrack(pc, connection, i, t); err != nil {
 			return err
 		}
+	}
 
-		sender, err := pc.AddTrack(track)
-		if err != nil {
-			log.Printf("[RTC] Failed to add track %s: %v", track.ID(), err)
-			return err
-		}
+	return nil
+}
+
+// addTrack creates a local sample track for trackID and attaches it to pc,
+// caller must hold connection.mu or own the connection exclusively
+func (rm *RTCManager) addTrack(pc *webrtc.PeerConnection, connection *RTCConnection, trackID uint8, t trackInfo) error {
+	if trackID == SCREEN_SHARE_VIDEO {
+		return rm.addScreenShareTrack(pc, connection, t)
+	}
 
-		// using uint8 flag as key
-		connection.tracks[i] = track
-		connection.senders[i] = sender
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: t.MimeType},
+		t.id,
+		t.streamID,
+	)
+	if err != nil {
+		log.Printf("[RTC] Failed to create track: %v", err)
+		return err
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		log.Printf("[RTC] Failed to add track %s: %v", track.ID(), err)
+		return err
+	}
 
-		// feedback from rtcp
+	// using uint8 flag as key
+	connection.tracks[trackID] = track
+	connection.senders[trackID] = sender
+
+	// feedback from rtcp
+	if t.Kind == webrtc.RTPCodecTypeVideo {
+		go handleVideoSenderRTCP(connection, trackID, sender)
+	} else {
 		go handleRTCP("sender:"+track.ID(), sender)
 	}
 
 	return nil
 }
 
-func handleTrack(track *webrtc.TrackRemote, peerIP string) {
+// addScreenShareTrack is addTrack for the RTP screen share track, see rtc_svc.go
+func (rm *RTCManager) addScreenShareTrack(pc *webrtc.PeerConnection, connection *RTCConnection, t trackInfo) error {
+	track, err := newScreenShareTrack(t, connection.screenCodec)
+	if err != nil {
+		log.Printf("[RTC] Failed to create track: %v", err)
+		return err
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		log.Printf("[RTC] Failed to add track %s: %v", track.ID(), err)
+		return err
+	}
+
+	connection.videoRTCtrack = track
+	connection.senders[SCREEN_SHARE_VIDEO] = sender
+
+	go handleVideoSenderRTCP(connection, SCREEN_SHARE_VIDEO, sender)
+
+	return nil
+}
+
+// removeTrack detaches the local track for trackID from pc,
+// caller must hold connection.mu
+func (rm *RTCManager) removeTrack(pc *webrtc.PeerConnection, connection *RTCConnection, trackID uint8) error {
+	sender, exists := connection.senders[trackID]
+	if !exists {
+		return nil
+	}
+
+	if err := pc.RemoveTrack(sender); err != nil {
+		log.Printf("[RTC] Failed to remove track %d: %v", trackID, err)
+		return err
+	}
+
+	delete(connection.tracks, trackID)
+	delete(connection.senders, trackID)
+	if trackID == SCREEN_SHARE_VIDEO {
+		connection.videoRTCtrack = nil
+	}
+
+	return nil
+}
+
+func handleTrack(track *webrtc.TrackRemote, peerIP string, pc *webrtc.PeerConnection) {
 	var found bool
 	for _, info := range trackMap {
 		if info.id == track.ID() {
@@ -139,9 +207,14 @@ func handleTrack(track *webrtc.TrackRemote, peerIP string) {
 			return
 		}
 	} else if track.Kind() == webrtc.RTPCodecTypeVideo &&
-		track.Codec().MimeType == webrtc.MimeTypeVP9 &&
+		isScreenCodec(track.Codec().MimeType) &&
 		track.ID() == trackMap[SCREEN_SHARE_VIDEO].id {
-		go depackVideoRTP(track, SCREEN_SHARE_VIDEO, peerIP)
+		go depackVideoRTP(track, SCREEN_SHARE_VIDEO, peerIP, pc)
+		return
+	} else if track.Kind() == webrtc.RTPCodecTypeVideo &&
+		strings.EqualFold(track.Codec().MimeType, trackMap[CAMERA_VIDEO].MimeType) &&
+		track.ID() == trackMap[CAMERA_VIDEO].id {
+		go depackVideoRTP(track, CAMERA_VIDEO, peerIP, pc)
 		return
 	} else {
 		log.Printf("Unsupported track kind or codec: Kind=%s, Codec=%s, ID=%s", track.Kind(), track.Codec().MimeType, track.ID())
@@ -149,10 +222,32 @@ func handleTrack(track *webrtc.TrackRemote, peerIP string) {
 	}
 }
 
-func depackVideoRTP(track *webrtc.TrackRemote, trackID uint8, peerIP string) {
-	depacketizer := codecs.VP9Packet{}
-	var frameBuffer []byte
-	var lastTimestamp uint32 = 0
+// videoDepacketizer picks the depacketizer for a video track's codec
+func videoDepacketizer(mimeType string) rtp.Depacketizer {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Packet{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return &codecs.AV1Depacketizer{}
+	}
+	return &codecs.VP9Packet{}
+}
+
+// depackVideoRTP reassembles the frames of a received video track for the
+// frontend, see rtc_reassembly.go. after the track started or lost a frame,
+// frames are dropped and the peer is asked for a keyframe with a PLI until one
+// arrives, the frames in between reference what the decoder never got
+func depackVideoRTP(track *webrtc.TrackRemote, trackID uint8, peerIP string, pc *webrtc.PeerConnection) {
+	mimeType := track.Codec().MimeType
+	codec, _ := codecID(mimeType)
+	assembler := newFrameAssembler(mimeType)
+	var clock rtpClock
+	var header videoFrameHeader // width and height carry over between frames
+	pli := pliSender{pc: pc, ssrc: uint32(track.SSRC())}
+	waitingForKeyframe := true
+	label := "receiver:" + track.ID()
 
 	go func() {
 		for {
@@ -162,40 +257,44 @@ func depackVideoRTP(track *webrtc.TrackRemote, trackID uint8, peerIP string) {
 				return
 			}
 
-			// 检查是否是新帧的开始
-			if rtpPacket.Timestamp != lastTimestamp && len(frameBuffer) > 0 {
-				// 发送完整的前一帧
-				ipBytes := ipv4ToBytes(peerIP)
-				headerSize := 1 + 4 // 1字节轨道ID + 4字节IP地址
-				totalSize := headerSize + len(frameBuffer)
-				packet := make([]byte, totalSize)
-
-				offset := 0
-				packet[offset] = SCREEN_SHARE_VIDEO // 轨道ID标识
-				offset += 1
-
-				// 添加IPv4地址（4字节）
-				copy(packet[offset:offset+4], ipBytes[:])
-				offset += 4
+			frames, lost := assembler.push(rtpPacket, time.Now())
+			if lost {
+				waitingForKeyframe = true
+				pli.sendPLI(label)
+			}
 
-				copy(packet[offset:], frameBuffer)
+			for _, frame := range frames {
+				keyframe := isKeyframe(mimeType, frame.data)
+				if waitingForKeyframe && !keyframe {
+					metricDroppedFrames.inc("awaiting_keyframe")
+					pli.sendPLI(label)
+					continue
+				}
+				waitingForKeyframe = false
+
+				header.codec = codec
+				header.flags, header.layer = 0, 0
+				header.rtpTimestamp = frame.timestamp
+				header.captureTime = clock.captureTime(frame.timestamp)
+				if keyframe {
+					header.flags |= CHUNK_FLAG_KEYFRAME
+					if width, height, ok := frameDimensions(mimeType, frame.data); ok {
+						header.width, header.height = width, height
+					}
+				}
+				if frame.svc {
+					header.layer = frame.sid
+					header.flags |= CHUNK_FLAG_SVC | frame.tid<<svcTemporalShift | frame.sid<<svcSpatialShift
+				}
+				packet := append(videoMediaHeader(trackID, peerIP, header, len(frame.data)), frame.data...)
 
-				err := sendMediaWs(packet)
-				if err != nil {
+				if err := sendMediaWs(packet); err != nil {
 					log.Printf("Failed to send video frame via WebSocket: %v", err)
+					metricDroppedFrames.inc("frontend_unavailable")
+				} else {
+					metricMediaChunksOut.inc(trackLabel(trackID))
 				}
-				frameBuffer = frameBuffer[:0] // 清空缓冲区
-			}
-			lastTimestamp = rtpPacket.Timestamp
-
-			// 解包RTP载荷
-			frameData, err := depacketizer.Unmarshal(rtpPacket.Payload)
-			if err != nil {
-				continue
 			}
-
-			// 将数据添加到帧缓冲区
-			frameBuffer = append(frameBuffer, frameData...)
 		}
 	}()
 }
@@ -212,32 +311,29 @@ func depackAudioRTP(track *webrtc.TrackRemote, trackID uint8, peerIP string) {
 			}
 			// log.Printf("Audio RTP packet received: Timestamp=%d, PayloadSize=%d", rtpPacket.Timestamp, len(rtpPacket.Payload))
 
+			if trackID == MICROPHONE_AUDIO && rtcManager.peerMuted(peerIP) {
+				// the peer's own gateway should have stopped sending already
+				metricDroppedFrames.inc("moderator_muted")
+				continue
+			}
+
 			// depack
 			opusFrame, err := depacketizer.Unmarshal(rtpPacket.Payload)
 			if err != nil {
 				log.Printf("Failed to unmarshal Opus packet: %v", err)
+				metricDroppedFrames.inc("depacketize")
 				continue
 			}
 
 			// create packet with header
-			ipBytes := ipv4ToBytes(peerIP)
-			headerSize := 1 + 4 // 1字节轨道ID + 4字节IP地址
-			totalSize := headerSize + len(opusFrame)
-			packet := make([]byte, totalSize)
-
-			offset := 0
-			packet[offset] = trackID // 轨道ID标识
-			offset += 1
-
-			// 添加IPv4地址（4字节）
-			copy(packet[offset:offset+4], ipBytes[:])
-			offset += 4
-
-			copy(packet[offset:], opusFrame)
+			packet := append(mediaHeader(trackID, peerIP, len(opusFrame)), opusFrame...)
 
 			err = sendMediaWs(packet)
 			if err != nil {
 				log.Printf("Failed to send audio frame via WebSocket: %v", err)
+				metricDroppedFrames.inc("frontend_unavailable")
+			} else {
+				metricMediaChunksOut.inc(trackLabel(trackID))
 			}
 		}
 	}()
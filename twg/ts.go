@@ -9,6 +9,7 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"runtime"
@@ -49,7 +50,7 @@ func openBrowser(url string) {
 	}
 }
 
-func initNodeInfo(selfIP string, hostname string) {
+func initNodeInfo(selfAddrs []netip.Addr, hostname string) {
 	randamID := func() uint64 {
 		max := new(big.Int)
 		max.Exp(big.NewInt(2), big.NewInt(64), nil).Sub(max, big.NewInt(1))
@@ -67,7 +68,15 @@ func initNodeInfo(selfIP string, hostname string) {
 		Hostname:    hostname,
 		StartTime:   time.Now().Unix(),
 		RandomID:    randamID,
-		TailscaleIP: selfIP,
+		TailscaleIP: preferredAddr(selfAddrs).String(),
+		TrickleICE:  trickleICE,
+
+		ProtocolVersion: PROTOCOL_VERSION,
+		Codecs:          localCodecs(),
+		TrackKinds:      localTrackKinds(),
+		Features:        localFeatures(),
+		PresenceKey:     presencePublicKey(),
+		TailscaleIPs:    addrStrings(selfAddrs),
 	}
 }
 
@@ -120,20 +129,21 @@ func initTS(hostName string, authKey string, dirPath string, isEphemeral bool) (
 	return result.srv, result.lc, result.udpConn, result.rtcConn, result.httpListener, result.httpClient
 }
 
-func initConns(server *tsnet.Server, selfIP string) (net.PacketConn, net.PacketConn, net.Listener, *http.Client) {
-	udpConn, err := server.ListenPacket("udp4", net.JoinHostPort(selfIP, udpPort))
+func initConns(server *tsnet.Server, selfAddrs []netip.Addr) (net.PacketConn, net.PacketConn, net.Listener, *http.Client) {
+	udpConn, err := listenDualStack(server, selfAddrs, udpPort)
 	if err != nil {
 		log.Panicf("Failed to create shared UDP connection: %v", err)
 	}
 
-	rtcConn, err := server.ListenPacket("udp4", net.JoinHostPort(selfIP, "0"))
+	rtcConn, err := listenDualStack(server, selfAddrs, "0")
 	if err != nil {
-		log.Panicf("Error listening on %s:0: %v", selfIP, err)
+		log.Panicf("Error listening for WebRTC: %v", err)
 	}
 
-	httpListener, err := server.Listen("tcp4", net.JoinHostPort(selfIP, tcpPort))
+	// every tailscale address of this node
+	httpListener, err := server.Listen("tcp", ":"+tcpPort)
 	if err != nil {
-		log.Panicf("Error listening on %s:%s: %v", selfIP, tcpPort, err)
+		log.Panicf("Error listening on :%s: %v", tcpPort, err)
 	}
 
 	// httpClient := server.HTTPClient()// tailscale's http client
@@ -293,12 +303,14 @@ func startBackendStateMonitor(
 						return
 					}
 
-					selfAddr := st.Self.TailscaleIPs[0].String()
-					initNodeInfo(selfAddr, hostname)
-					udpConn, rtcConn, httpListener, httpClient := initConns(srv, selfAddr)
+					selfAddrs := st.Self.TailscaleIPs
+					initPresenceKey(srv.Dir)
+					initNodeInfo(selfAddrs, hostname)
+					udpConn, rtcConn, httpListener, httpClient := initConns(srv, selfAddrs)
 
 					// 初始化PeerPingManager
 					initPeerPingManager(lc, ctx)
+					initPeerAccessManager(lc, ctx)
 
 					// status stdout loop
 					ticker := time.NewTicker(1 * time.Second)
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// access control from the tailnet policy file. a peer's roles come from the
+// app capability it has been granted towards this node, e.g.
+//
+//	"grants": [{
+//		"src": ["group:staff"],
+//		"dst": ["tag:relayx"],
+//		"app": {"relayx.example/cap": [{"roles": ["join", "moderate"]}]}
+//	}]
+//
+// without the capability a peer gets no connection at all. enforcement is off
+// unless enabled with --access-control or RELAYX_ACCESS_CONTROL=1, while off
+// every peer is treated as having the join role and rooms are moderated by
+// their creator, see rtc_moderation.go.
+
+const relayxCapability tailcfg.PeerCapability = "relayx.example/cap"
+
+// relayxMetricsCapability lets a peer scrape /metrics on the tailnet listener,
+// granted like relayxCapability with an empty value, e.g.
+// "app": {"relayx.example/metrics": [{}]}
+const relayxMetricsCapability tailcfg.PeerCapability = "relayx.example/metrics"
+
+type PeerRole string
+
+const (
+	ROLE_JOIN        PeerRole = "join"        // full participation
+	ROLE_MODERATE    PeerRole = "moderate"    // join plus moderator actions
+	ROLE_LISTEN_ONLY PeerRole = "listen-only" // receives media, its media and messages are ignored
+)
+
+var accessCacheTTL = 30 * time.Second
+
+type relayxCapValue struct {
+	Roles []PeerRole `json:"roles"`
+}
+
+// PeerAccess is the set of roles granted to a peer, and the capabilities
+// private rooms can ask for
+type PeerAccess struct {
+	Roles []PeerRole               `json:"roles"`
+	Caps  []tailcfg.PeerCapability `json:"caps,omitempty"`
+}
+
+func (a PeerAccess) has(role PeerRole) bool {
+	for _, r := range a.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canConnect allows a WebRTC connection with the peer
+func (a PeerAccess) canConnect() bool {
+	return a.has(ROLE_JOIN) || a.has(ROLE_MODERATE) || a.has(ROLE_LISTEN_ONLY)
+}
+
+// canSend allows the peer's media and data channel messages to reach us
+func (a PeerAccess) canSend() bool {
+	return a.has(ROLE_JOIN) || a.has(ROLE_MODERATE)
+}
+
+func (a PeerAccess) canModerate() bool {
+	return a.has(ROLE_MODERATE)
+}
+
+// hasCapability reports whether the peer was granted capability, used by private rooms
+func (a PeerAccess) hasCapability(capability tailcfg.PeerCapability) bool {
+	return slices.Contains(a.Caps, capability)
+}
+
+var fullAccess = PeerAccess{Roles: []PeerRole{ROLE_JOIN}}
+
+// accessFromWhoIs extracts the relayx roles and the granted capabilities
+// from a WhoIs response
+func accessFromWhoIs(who *apitype.WhoIsResponse) PeerAccess {
+	var caps []tailcfg.PeerCapability
+	for capability := range who.CapMap {
+		caps = append(caps, capability)
+	}
+	if !accessControl {
+		return PeerAccess{Roles: fullAccess.Roles, Caps: caps}
+	}
+
+	values, err := tailcfg.UnmarshalCapJSON[relayxCapValue](who.CapMap, relayxCapability)
+	if err != nil {
+		log.Printf("[access] Failed to parse %s capability: %v", relayxCapability, err)
+		return PeerAccess{Caps: caps}
+	}
+
+	access := PeerAccess{Caps: caps}
+	for _, value := range values {
+		for _, role := range value.Roles {
+			if !access.has(role) {
+				access.Roles = append(access.Roles, role)
+			}
+		}
+	}
+	return access
+}
+
+type accessEntry struct {
+	access    PeerAccess
+	fetchedAt time.Time
+}
+
+// the PeerAccessManager caches peer roles so hot paths never wait for WhoIs
+type PeerAccessManager struct {
+	lc       *local.Client
+	ctx      context.Context
+	cache    map[string]accessEntry // key is peerIP
+	fetching map[string]bool
+	mu       sync.RWMutex
+}
+
+func initPeerAccessManager(lc *local.Client, ctx context.Context) {
+	peerAccessManager = &PeerAccessManager{
+		lc:       lc,
+		ctx:      ctx,
+		cache:    make(map[string]accessEntry),
+		fetching: make(map[string]bool),
+	}
+}
+
+// store records roles resolved elsewhere, e.g. by the signaling handlers
+func (pam *PeerAccessManager) store(peerIP string, access PeerAccess) {
+	pam.mu.Lock()
+	defer pam.mu.Unlock()
+	pam.cache[peerIP] = accessEntry{access: access, fetchedAt: time.Now()}
+}
+
+// cached returns the known roles of peerIP. a missing or stale entry is
+// refreshed in the background, known is false until the first lookup is done.
+func (pam *PeerAccessManager) cached(peerIP string) (access PeerAccess, known bool) {
+	if pam == nil {
+		return fullAccess, true
+	}
+
+	pam.mu.Lock()
+	defer pam.mu.Unlock()
+
+	entry, exists := pam.cache[peerIP]
+	if (!exists || time.Since(entry.fetchedAt) > accessCacheTTL) && !pam.fetching[peerIP] {
+		pam.fetching[peerIP] = true
+		go pam.refresh(peerIP)
+	}
+	if !exists && !accessControl {
+		// the roles don't wait for WhoIs, only the capabilities do
+		return fullAccess, true
+	}
+	return entry.access, exists
+}
+
+func (pam *PeerAccessManager) refresh(peerIP string) {
+	defer func() {
+		pam.mu.Lock()
+		delete(pam.fetching, peerIP)
+		pam.mu.Unlock()
+	}()
+
+	who, err := pam.lc.WhoIs(pam.ctx, peerIP)
+	if err != nil {
+		log.Printf("[access] WhoIs %s failed: %v", peerIP, err)
+		return
+	}
+	pam.store(peerIP, accessFromWhoIs(who))
+}
+
+// peerAccess is the lookup used by the rtc code, unknown peers get no roles
+func peerAccess(peerIP string) PeerAccess {
+	access, _ := peerAccessManager.cached(peerIP)
+	return access
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestAccessFromWhoIs(t *testing.T) {
+	const roomCap tailcfg.PeerCapability = "example.com/cap/standup"
+	who := &apitype.WhoIsResponse{CapMap: tailcfg.PeerCapMap{
+		relayxCapability: {`{"roles":["listen-only"]}`},
+		roomCap:          nil,
+	}}
+
+	enabled := accessControl
+	t.Cleanup(func() { accessControl = enabled })
+
+	accessControl = false
+	access := accessFromWhoIs(who)
+	if !access.canSend() || access.canModerate() {
+		t.Fatalf("got roles %v without access control, want join", access.Roles)
+	}
+	if !access.hasCapability(roomCap) {
+		t.Fatal("private room capability ignored without access control")
+	}
+
+	accessControl = true
+	access = accessFromWhoIs(who)
+	if access.canSend() || !access.canConnect() {
+		t.Fatalf("got roles %v, want listen-only", access.Roles)
+	}
+	if !access.hasCapability(roomCap) || access.hasCapability("example.com/cap/other") {
+		t.Fatalf("got capabilities %v", access.Caps)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// dual-stack: a node listens on every tailscale address it has. it is keyed by
+// its preferred address, IPv4 when it has one, so nodes with only an IPv6
+// tailnet address take part too. the key is the node's identity, not its
+// route: tailscale assigns a node its addresses for good, and a packet from
+// any of them is mapped back to the key. presence goes to the preferred
+// address and only falls back to the others when it can't be sent there, and
+// signaling falls back across them until one answers, so a node whose IPv4
+// path is broken is still reached over IPv6.
+
+// preferredAddr picks the address a node is keyed by
+func preferredAddr(addrs []netip.Addr) netip.Addr {
+	for _, addr := range addrs {
+		if addr.Is4() {
+			return addr
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return netip.Addr{}
+}
+
+func addrStrings(addrs []netip.Addr) []string {
+	strs := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		strs = append(strs, addr.String())
+	}
+	return strs
+}
+
+// tailnetAddrs remembers every address of a node, from presence (after it was
+// verified) and from the tailnet status
+var tailnetAddrs = struct {
+	byPeer map[string][]string // key is peerIP, the preferred address comes first
+	mu     sync.RWMutex
+}{byPeer: make(map[string][]string)}
+
+// notePeerAddrs records the addresses of a node and returns the key it goes by
+func notePeerAddrs(addrs []netip.Addr) string {
+	preferred := preferredAddr(addrs)
+	if !preferred.IsValid() {
+		return ""
+	}
+	strs := []string{preferred.String()}
+	for _, addr := range addrs {
+		if addr != preferred {
+			strs = append(strs, addr.String())
+		}
+	}
+
+	tailnetAddrs.mu.Lock()
+	tailnetAddrs.byPeer[strs[0]] = strs
+	tailnetAddrs.mu.Unlock()
+	return strs[0]
+}
+
+// peerAddrs returns every known address of peerIP, peerIP itself first
+func peerAddrs(peerIP string) []string {
+	tailnetAddrs.mu.RLock()
+	defer tailnetAddrs.mu.RUnlock()
+	if addrs, exists := tailnetAddrs.byPeer[peerIP]; exists {
+		return addrs
+	}
+	return []string{peerIP}
+}
+
+// parseAddrs parses the addresses in a NodeInfo, skipping invalid ones
+func parseAddrs(strs []string) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(strs))
+	for _, s := range strs {
+		if addr, err := netip.ParseAddr(s); err == nil && !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// dualStackConn joins one PacketConn per address family. WriteTo picks the
+// conn matching the target, ReadFrom merges what both receive.
+type dualStackConn struct {
+	conns     []net.PacketConn
+	readOnce  sync.Once
+	packets   chan packet
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type packetListener interface {
+	ListenPacket(network, addr string) (net.PacketConn, error)
+}
+
+// listenDualStack listens on port on every address, a single conn is returned as is
+func listenDualStack(server packetListener, addrs []netip.Addr, port string) (net.PacketConn, error) {
+	var conns []net.PacketConn
+	for _, addr := range addrs {
+		conn, err := server.ListenPacket("udp", net.JoinHostPort(addr.String(), port))
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %w", addr, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	if len(conns) == 1 {
+		return conns[0], nil
+	}
+	return &dualStackConn{
+		conns:   conns,
+		packets: make(chan packet),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// splitConn returns the per-family conns behind conn
+func splitConn(conn net.PacketConn) []net.PacketConn {
+	if d, ok := conn.(*dualStackConn); ok {
+		return d.conns
+	}
+	return []net.PacketConn{conn}
+}
+
+func isUDP4(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && udpAddr.IP.To4() != nil
+}
+
+func (d *dualStackConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	for _, conn := range d.conns {
+		if isUDP4(conn.LocalAddr()) == isUDP4(addr) {
+			return conn.WriteTo(b, addr)
+		}
+	}
+	return 0, fmt.Errorf("no local address for %s", addr)
+}
+
+// ReadFrom returns io.EOF once the conn is closed
+func (d *dualStackConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	d.readOnce.Do(func() {
+		for _, conn := range d.conns {
+			go d.readLoop(conn)
+		}
+	})
+
+	select {
+	case p := <-d.packets:
+		n := copy(b, p.data)
+		return n, p.addr, p.err
+	case <-d.done:
+		return 0, nil, io.EOF
+	}
+}
+
+// readRetryDelay is the pause after a read error, so a failing conn doesn't spin
+var readRetryDelay = 100 * time.Millisecond
+
+// readLoop forwards what conn receives, errors included. it only stops once
+// conn is closed, a failed read doesn't take the address family down
+func (d *dualStackConn) readLoop(conn net.PacketConn) {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			return
+		}
+		p := packet{data: append([]byte(nil), buffer[:n]...), addr: addr, err: err}
+		select {
+		case d.packets <- p:
+		case <-d.done:
+			return
+		}
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			select {
+			case <-time.After(readRetryDelay):
+			case <-d.done:
+				return
+			}
+		}
+	}
+}
+
+func (d *dualStackConn) Close() error {
+	var firstErr error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		for _, conn := range d.conns {
+			if err := conn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+func (d *dualStackConn) LocalAddr() net.Addr {
+	return d.conns[0].LocalAddr()
+}
+
+func (d *dualStackConn) SetDeadline(t time.Time) error {
+	for _, conn := range d.conns {
+		if err := conn.SetDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dualStackConn) SetReadDeadline(t time.Time) error {
+	for _, conn := range d.conns {
+		if err := conn.SetReadDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dualStackConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range d.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -38,7 +38,8 @@ func (ppm *PeerPingManager) checkPeerConnections(st *ipnstate.Status) {
 
 		// as long as the connection mode is not direct, do the discovery ping
 		if peer.CurAddr == "" && peer.Relay != "" {
-			peerIP := peer.TailscaleIPs[0].String()
+			peerAddr := preferredAddr(peer.TailscaleIPs)
+			peerIP := peerAddr.String()
 
 			// check onlinePeers
 			onlinePeersMu.RLock()
@@ -56,8 +57,8 @@ func (ppm *PeerPingManager) checkPeerConnections(st *ipnstate.Status) {
 					ppm.peerPingState[peerIP] = "pinging"
 					ppm.mu.Unlock()
 
-					log.Printf("Starting to ping peer %s (%s) to promote direct connection", peer.HostName, peer.TailscaleIPs[0])
-					go ppm.startPing(peer.TailscaleIPs[0])
+					log.Printf("Starting to ping peer %s (%s) to promote direct connection", peer.HostName, peerAddr)
+					go ppm.startPing(peerAddr)
 				}
 			}
 		}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// PeerIdentity is who tailscale says is on the other end of a connection
+type PeerIdentity struct {
+	NodeID    tailcfg.StableNodeID `json:"nodeId"`
+	NodeName  string               `json:"nodeName"`
+	UserLogin string               `json:"userLogin,omitempty"`
+	UserName  string               `json:"userName,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+}
+
+func identityFromWhoIs(who *apitype.WhoIsResponse) *PeerIdentity {
+	identity := &PeerIdentity{
+		NodeID:   who.Node.StableID,
+		NodeName: who.Node.Name,
+		Tags:     who.Node.Tags,
+	}
+	if who.UserProfile != nil {
+		identity.UserLogin = who.UserProfile.LoginName
+		identity.UserName = who.UserProfile.DisplayName
+	}
+	return identity
+}
+
+// authenticatePeer resolves the real sender of r with WhoIs and checks that it
+// owns claimedIP. on failure the returned status is the one to answer with.
+func authenticatePeer(lc *local.Client, r *http.Request, claimedIP string) (*apitype.WhoIsResponse, int, error) {
+	claimed, err := netip.ParseAddr(claimedIP)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid from address %q", claimedIP)
+	}
+
+	who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+	if errors.Is(err, local.ErrPeerNotFound) {
+		return nil, http.StatusUnauthorized, fmt.Errorf("unknown peer %s", r.RemoteAddr)
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("whois %s: %v", r.RemoteAddr, err)
+	}
+	if who.Node == nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("whois %s returned no node", r.RemoteAddr)
+	}
+
+	for _, prefix := range who.Node.Addresses {
+		if prefix.Addr() == claimed {
+			return who, http.StatusOK, nil
+		}
+	}
+
+	return nil, http.StatusForbidden, fmt.Errorf("%s (%s) claims to be %s", r.RemoteAddr, who.Node.Name, claimedIP)
+}
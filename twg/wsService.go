@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"sync"
@@ -13,6 +14,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
+	"tailscale.com/tailcfg"
 )
 
 var (
@@ -107,6 +109,8 @@ func initWsService() {
 		}
 	})
 
+	http.HandleFunc("/metrics", metricsHandler)
+
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		log.Printf("ws listen error: %v", err)
@@ -125,6 +129,7 @@ func initWsService() {
 		"type":    "ws",
 		"mediaWs": fmt.Sprintf("ws://%s", addr),
 		"msgWs":   fmt.Sprintf("ws://%s/msg", addr),
+		"metrics": fmt.Sprintf("http://%s/metrics", addr),
 	}
 	if b, err := json.Marshal(info); err == nil {
 		fmt.Println(string(b))
@@ -149,33 +154,75 @@ func selectBestAudioFrame(targetBitrate uint32) uint32 {
 
 var currentBitrate = audioBitrateList[0]
 
+const AUDIO_CHUNK_HEADER_SIZE = 13 // trackID, duration and bitrate
+
+// handleMediaChunk writes a media chunk from the frontend to the peers' tracks. chunk formats:
+//
+//	audio: [trackID][8B duration ns LE][4B bitrate LE][opus frame]
+//	video: [trackID][video frame header][frame], see rtc_frames.go
+//
+// video layers are the simulcast encodings, see rtc_simulcast.go. the flags
+// mark keyframes and carry the VP9 SVC layer IDs, see rtc_svc.go. screen share
+// is encoded once per codec in use, see rtc_codecs.go. video is paced by the
+// capture timestamps
 func handleMediaChunk(data []byte) {
-	if len(data) < 10 {
+	isAudio := len(data) > 0 && (data[0] == CPA_AUDIO || data[0] == MICROPHONE_AUDIO)
+	if len(data) == 0 || (isAudio && len(data) < AUDIO_CHUNK_HEADER_SIZE) {
 		log.Printf("Invalid packet size: %d", len(data))
+		metricDroppedFrames.inc("invalid_chunk")
 		return
 	}
 	trackID := data[0]
+	metricMediaChunksIn.inc(trackLabel(trackID))
 	var duration time.Duration
 	var mediaData []byte
 	var chunkBitrate uint32
-	if trackID == SCREEN_SHARE_VIDEO {
-		duration = time.Second / 30
-	} else {
+	var frame videoFrameHeader
+	var layer, highestLayer int
+	var keyframe bool
+	if isAudio {
 		duration = time.Duration(binary.LittleEndian.Uint64(data[1:9]))
-	}
-	if trackID == CPA_AUDIO || trackID == MICROPHONE_AUDIO {
 		chunkBitrate = binary.LittleEndian.Uint32(data[9:13])
-		mediaData = data[13:]
+		mediaData = data[AUDIO_CHUNK_HEADER_SIZE:]
 	} else {
-		mediaData = data[9:]
+		var err error
+		frame, mediaData, err = parseVideoFrameHeader(data[1:])
+		if err != nil || int(frame.layer) >= len(layerBitrates(trackID)) {
+			log.Printf("Invalid video chunk: size %d", len(data))
+			metricDroppedFrames.inc("invalid_chunk")
+			return
+		}
+		layer = int(frame.layer)
+		keyframe = frame.keyframe()
+		duration = frameDuration(trackID, frame)
+		highestLayer = noteSimulcastLayer(trackID, layer)
+	}
+
+	var screenPackets []screenPacket
+	var temporalLayerRates [maxSVCLayers]uint32
+	if trackID == SCREEN_SHARE_VIDEO {
+		timestamp := captureRTPTimestamp(frame.captureTime)
+		screenPackets = packetizeScreenShare(frame.codec, layer, chunkSVC(frame.flags), keyframe, timestamp, mediaData)
+		if len(screenPackets) == 0 {
+			metricDroppedFrames.inc("packetize")
+			return
+		}
+		temporalLayerRates = temporalRates(frame.codec, layer)
+	}
+
+	if trackID == MICROPHONE_AUDIO && rtcManager.localMuted() {
+		// muted by a moderator, the frontend's own mute state doesn't matter
+		metricDroppedFrames.inc("moderator_muted")
+		return
 	}
 
-	// write sample to connections which is in chat
+	// write sample to connections which is in chat, in the local room
+	room := localRoom()
 	rtcManager.mu.RLock()
 	defer rtcManager.mu.RUnlock()
 	for _, connection := range rtcManager.connections {
 		connection.mu.RLock()
-		if connection.isInChat != true {
+		if connection.isInChat != true || effectiveRoom(connection.room) != room || !rtcManager.roomAdmitsLocked(connection, room) {
 			connection.mu.RUnlock()
 			continue
 		}
@@ -183,22 +230,43 @@ func handleMediaChunk(data []byte) {
 			connection.mu.RUnlock()
 			continue
 		}
+		if trackID == SCREEN_SHARE_VIDEO {
+			if connection.videoRTCtrack == nil {
+				metricDroppedFrames.inc("no_track")
+			} else if id, _ := codecID(connection.screenCodec); id == frame.codec &&
+				forwardLayer(connection, trackID, layer, keyframe, highestLayer) {
+				// chunks in other codecs are for other peers
+				writeScreenPackets(connection, screenPackets, temporalLayerRates)
+			}
+			connection.mu.RUnlock()
+			continue
+		}
+
 		track, exist := connection.tracks[trackID]
 		if !exist {
 			log.Printf("Track not found: %d", trackID)
+			metricDroppedFrames.inc("no_track")
 			connection.mu.RUnlock()
 			continue
 		}
 
-		if chunkBitrate == selectBestAudioFrame(uint32(connection.targetBitrate/2)) {
+		if !isAudio && !forwardLayer(connection, trackID, layer, keyframe, highestLayer) {
+			connection.mu.RUnlock()
+			continue
+		}
+
+		// audio comes in several bitrates, only the one fitting the peer is sent
+		if !isAudio || chunkBitrate == selectBestAudioFrame(uint32(connection.targetBitrate/2)) {
 			if chunkBitrate != currentBitrate && trackID == MICROPHONE_AUDIO {
 				currentBitrate = chunkBitrate
 				go sendMsgWs([]byte(fmt.Sprintf(`{"type":"setAudioBitrate","peerIP":"%s","bitrate":%d}`, connection.peerIP, currentBitrate)))
 			}
-			track.WriteSample(media.Sample{
+			if err := track.WriteSample(media.Sample{
 				Data:     mediaData,
 				Duration: duration,
-			})
+			}); err != nil {
+				metricDroppedFrames.inc("write_failed")
+			}
 		}
 
 		connection.mu.RUnlock()
@@ -225,6 +293,8 @@ func handleMessage(data []byte) {
 					err := connection.dc.SendText(string(data))
 					if err != nil {
 						log.Printf("[RTC] Failed to send userState to %s via dc: %v", connection.peerIP, err)
+					} else {
+						metricDataChannelMessages.inc("out")
 					}
 				}
 			}
@@ -243,9 +313,17 @@ func handleMessage(data []byte) {
 				}
 
 				mirrorStateMu.Lock()
+				// the room belongs to joinRoom, the frontend's state doesn't carry it
+				newState.Room = mirrorState.Room
+				newState.RoomSince = mirrorState.RoomSince
+				changed := *summarizeState(mirrorState) != *summarizeState(newState)
 				mirrorState = newState
 				mirrorStateMu.Unlock()
 
+				if changed {
+					triggerPresenceBurst()
+				}
+
 				if rtcManager != nil {
 					go rtcManager.broadcastUserState(newState)
 				}
@@ -254,6 +332,79 @@ func handleMessage(data []byte) {
 			} else {
 				log.Printf("[userState] mirrorLocalState message does not contain userState field")
 			}
+		case "joinRoom":
+			// {"type":"joinRoom","room":"standup","secret":"","capability":""}, the peers are told over the data channel.
+			// a secret or capability makes the room private
+			var req struct {
+				Room       string `json:"room"`
+				Secret     string `json:"secret"`
+				Capability string `json:"capability"`
+			}
+			if err := json.Unmarshal(data, &req); err != nil || req.Room == "" {
+				log.Printf("[rooms] joinRoom message without room")
+				break
+			}
+			if rtcManager != nil {
+				rtcManager.joinRoom(req.Room, roomPolicy{
+					secret:     req.Secret,
+					capability: tailcfg.PeerCapability(req.Capability),
+				})
+			}
+		case "moderate":
+			// {"type":"moderate","action":"mute-peer","target":"100.64.0.2"}, applies to the local room
+			var req struct {
+				Action string `json:"action"`
+				Target string `json:"target"`
+			}
+			if err := json.Unmarshal(data, &req); err != nil {
+				log.Printf("[moderation] Failed to parse moderate message: %v", err)
+				break
+			}
+			if rtcManager != nil {
+				rtcManager.moderate(req.Action, req.Target)
+			}
+		case "leaveRoom":
+			if rtcManager != nil {
+				rtcManager.joinRoom("", roomPolicy{})
+			}
+		case "renegotiate":
+			// {"type":"renegotiate","peerIP":"","addTracks":[2],"removeTracks":[]}, empty peerIP means every peer
+			var req struct {
+				PeerIP       string `json:"peerIP"`
+				AddTracks    []int  `json:"addTracks"`
+				RemoveTracks []int  `json:"removeTracks"`
+			}
+			if err := json.Unmarshal(data, &req); err != nil {
+				log.Printf("[renegotiate] Failed to parse renegotiate message: %v", err)
+				break
+			}
+			// ids outside trackMap would wrap around in uint8 and hit another track
+			toTrackIDs := func(ids []int) ([]uint8, error) {
+				trackIDs := make([]uint8, 0, len(ids))
+				for _, id := range ids {
+					if id < 0 || id > math.MaxUint8 {
+						return nil, fmt.Errorf("track id %d out of range", id)
+					}
+					if _, known := trackMap[uint8(id)]; !known {
+						return nil, fmt.Errorf("unknown track id %d", id)
+					}
+					trackIDs = append(trackIDs, uint8(id))
+				}
+				return trackIDs, nil
+			}
+			addTrackIDs, err := toTrackIDs(req.AddTracks)
+			if err != nil {
+				log.Printf("[renegotiate] Invalid addTracks: %v", err)
+				break
+			}
+			removeTrackIDs, err := toTrackIDs(req.RemoveTracks)
+			if err != nil {
+				log.Printf("[renegotiate] Invalid removeTracks: %v", err)
+				break
+			}
+			if rtcManager != nil {
+				go rtcManager.renegotiatePeers(req.PeerIP, addTrackIDs, removeTrackIDs)
+			}
 		case "dm":
 			if _, ok := jsonData.(map[string]interface{})["content"].(string); !ok {
 				log.Printf("[dm] dm message does not contain content field")
@@ -280,10 +431,23 @@ func handleDM(jsonData interface{}, data []byte) {
 		}
 	}
 
+	// room chat carries the room and only goes to its admitted members
+	room, isRoomChat := jsonData.(map[string]interface{})["room"].(string)
+
 	log.Printf("[dm] Sending message to peers: %v", targetPeers)
 
+	rtcManager.mu.RLock()
+	defer rtcManager.mu.RUnlock()
 	for _, connection := range rtcManager.connections {
 		if connection.dc != nil && connection.dc.ReadyState() == webrtc.DataChannelStateOpen {
+			if isRoomChat {
+				connection.mu.RLock()
+				member := connection.isInChat && effectiveRoom(connection.room) == effectiveRoom(room) && rtcManager.roomAdmitsLocked(connection, room)
+				connection.mu.RUnlock()
+				if !member {
+					continue
+				}
+			}
 			// 如果有 targetPeers 字段，检查当前连接是否在目标列表中
 			if len(targetPeers) > 0 {
 				found := false
@@ -303,6 +467,7 @@ func handleDM(jsonData interface{}, data []byte) {
 				log.Printf("[RTC] Failed to send dm to %s via dc: %v", connection.peerIP, err)
 			} else {
 				log.Printf("[RTC] Successfully sent dm to %s via dc", connection.peerIP)
+				metricDataChannelMessages.inc("out")
 			}
 		}
 	}
@@ -347,14 +512,18 @@ func sendMediaWs(data []byte) error {
 
 // RTCConnectionStatus 表示RTC连接的状态信息
 type RTCConnectionStatus struct {
-	PeerIP           string    `json:"peerIP"`
-	Role             string    `json:"role"`
-	State            string    `json:"state"`
-	CreatedAt        time.Time `json:"createdAt"`
-	LastPingTime     time.Time `json:"lastPingTime"`
-	Latency          string    `json:"latency"`
-	HasDataChannel   bool      `json:"hasDataChannel"`
-	DataChannelReady bool      `json:"dataChannelReady"`
+	PeerIP           string        `json:"peerIP"`
+	Role             string        `json:"role"`
+	State            string        `json:"state"`
+	CreatedAt        time.Time     `json:"createdAt"`
+	LastPingTime     time.Time     `json:"lastPingTime"`
+	Latency          string        `json:"latency"`
+	HasDataChannel   bool          `json:"hasDataChannel"`
+	DataChannelReady bool          `json:"dataChannelReady"`
+	PeerIdentity     *PeerIdentity `json:"peerIdentity,omitempty"`
+	Features         []string      `json:"features"`
+	Room             string        `json:"room,omitempty"`
+	ScreenCodec      string        `json:"screenCodec"`
 }
 
 // RTCManagerStatus 表示整个RTC管理器的状态信息
@@ -363,16 +532,19 @@ type RTCManagerStatus struct {
 	Timestamp   time.Time             `json:"timestamp"`
 	Connections []RTCConnectionStatus `json:"connections"`
 	TotalPeers  int                   `json:"totalPeers"`
+	// codec IDs screen share has to be encoded in, see rtc_codecs.go
+	ScreenCodecs []int `json:"screenCodecs"`
 }
 
 // getRTCManagerStatus 获取RTC管理器的当前状态
 func getRTCManagerStatus() *RTCManagerStatus {
 	if rtcManager == nil {
 		return &RTCManagerStatus{
-			Type:        "rtc_status",
-			Timestamp:   time.Now(),
-			Connections: []RTCConnectionStatus{},
-			TotalPeers:  0,
+			Type:         "rtc_status",
+			Timestamp:    time.Now(),
+			Connections:  []RTCConnectionStatus{},
+			TotalPeers:   0,
+			ScreenCodecs: []int{},
 		}
 	}
 
@@ -380,10 +552,11 @@ func getRTCManagerStatus() *RTCManagerStatus {
 	defer rtcManager.mu.RUnlock()
 
 	status := &RTCManagerStatus{
-		Type:        "rtc_status",
-		Timestamp:   time.Now(),
-		Connections: make([]RTCConnectionStatus, 0, len(rtcManager.connections)),
-		TotalPeers:  len(rtcManager.connections),
+		Type:         "rtc_status",
+		Timestamp:    time.Now(),
+		Connections:  make([]RTCConnectionStatus, 0, len(rtcManager.connections)),
+		TotalPeers:   len(rtcManager.connections),
+		ScreenCodecs: rtcManager.screenCodecsInUseLocked(),
 	}
 
 	for _, connection := range rtcManager.connections {
@@ -414,6 +587,10 @@ func getRTCManagerStatus() *RTCManagerStatus {
 			Latency:          latencyStr,
 			HasDataChannel:   connection.dc != nil,
 			DataChannelReady: dataChannelReady,
+			PeerIdentity:     connection.identity,
+			Features:         connection.featureList(),
+			Room:             connection.room,
+			ScreenCodec:      connection.screenCodec,
 		}
 
 		connection.pingMu.RUnlock()
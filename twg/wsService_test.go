@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestHandleMediaChunkShort(t *testing.T) {
+	// too short for their headers, dropped without touching any connection
+	chunks := [][]byte{
+		nil,
+		{MICROPHONE_AUDIO},
+		append([]byte{CPA_AUDIO}, make([]byte, 10)...),
+		append([]byte{MICROPHONE_AUDIO}, make([]byte, AUDIO_CHUNK_HEADER_SIZE-2)...),
+		append([]byte{SCREEN_SHARE_VIDEO}, make([]byte, VIDEO_FRAME_HEADER_SIZE)...),
+	}
+	for _, chunk := range chunks {
+		handleMediaChunk(chunk)
+	}
+}